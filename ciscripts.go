@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// ciScript is a script from github.com/Clever/ci-scripts that circle.yml commands run
+type ciScript struct {
+	// Name is the name of steps that run the script
+	Name string
+	// Requires are the helper steps the script needs, besides ci-scripts itself
+	Requires []string
+}
+
+// ciScripts are the ci-scripts scripts we know about, keyed by file name
+var ciScripts = map[string]ciScript{
+	"docker-publish":   {"Publish docker image", []string{REMOTE_DOCKER_REQUIREMENT, AWSCLI_REQUIREMENT}},
+	"catapult-publish": {"Publish to catapult", nil},
+	"dapple-deploy":    {"Deploy with dapple", nil},
+	"report-card":      {"Run report card", []string{REMOTE_DOCKER_REQUIREMENT}},
+	"npm-publish":      {"Publish to npm", []string{NODE_REQUIREMENT}},
+	"github-release":   {"Create GitHub release", nil},
+	"golang-install":   {"Install go", nil},
+	"golang-move-repo": {"Move repo into GOPATH", nil},
+}
+
+// ciScriptRegexp matches a command running a ci-scripts script, e.g. $HOME/ci-scripts/circleci/docker-publish
+var ciScriptRegexp = regexp.MustCompile(`(?:\$HOME|\$\{HOME\}|~)/ci-scripts/(?:circleci/)?([A-Za-z0-9_.-]+)`)
+
+// ciScriptsIn returns the names of the ci-scripts scripts a command runs, in order
+func ciScriptsIn(command string) []string {
+	names := []string{}
+	for _, match := range ciScriptRegexp.FindAllStringSubmatch(command, -1) {
+		if !contains(names, match[1]) {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// recognizeCIScripts names each run step that runs a known ci-scripts script after the script, and adds what
+// those scripts need (including ci-scripts itself) to requirements
+func recognizeCIScripts(v2 *models.CircleYamlV2, requirements requirements) {
+	for i, step := range v2.Jobs.Build.Steps {
+		name, command, ok := runCommand(step)
+		if !ok {
+			continue
+		}
+		scripts := ciScriptsIn(command)
+		if len(scripts) == 0 {
+			continue
+		}
+
+		stepNames := []string{}
+		for _, script := range scripts {
+			evidence := commandEvidence(script, "command runs ci-scripts "+script)
+			requirements.add(CI_SCRIPTS_REQUIREMENT, i, evidence)
+			known, ok := ciScripts[script]
+			if !ok {
+				warn(INFO_SEVERITY, MANUAL_FOLLOW_UP_WARNING, fmt.Sprintf("unrecognized ci-scripts script %s -- check what it needs", script), evidence)
+				continue
+			}
+			stepNames = append(stepNames, fmt.Sprintf("%s (%s)", known.Name, script))
+			for _, requirement := range known.Requires {
+				requirements.add(requirement, i, evidence)
+			}
+		}
+		if name == "" && len(stepNames) > 0 {
+			v2.Jobs.Build.Steps[i] = map[string]interface{}{
+				"run": map[string]string{
+					"name":    strings.Join(stepNames, ", "),
+					"command": command,
+				},
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// CircleCI 1.0 created this user and database in postgres and mysql, and many repos' tests rely on them
+const CIRCLE_1_DATABASE_USER = "ubuntu"
+const CIRCLE_1_DATABASE = "circle_test"
+
+// DEFAULT_DATABASE_PASSWORD is the password given to a user an image won't create without one
+const DEFAULT_DATABASE_PASSWORD = "circle_test"
+
+// databaseCredentials are the environment variables that tell a database image which user and database to create
+type databaseCredentials struct {
+	// Schemes are the schemes of connection strings for the database, e.g. postgres in postgres://ubuntu@localhost/circle_test
+	Schemes     []string
+	UserEnv     string
+	PasswordEnv string
+	DatabaseEnv string
+	// RootUser is the user the image always creates, which can't be set with UserEnv, if there is one,
+	// RootPasswordEnv sets its password, and EmptyRootPasswordEnv lets it have none
+	RootUser             string
+	RootPasswordEnv      string
+	EmptyRootPasswordEnv string
+	// UserNeedsPassword is true if the image ignores UserEnv unless PasswordEnv is set too
+	UserNeedsPassword bool
+}
+
+// connectionStringFormat matches the part of a connection string to a local database after its scheme, e.g.
+// ://ubuntu:secret@localhost:5432/circle_test. Values that use variables (e.g. $USER) don't match.
+const connectionStringFormat = `://(?:([^:@/\s'"$]+)(?::([^@/\s'"$]*))?@)?(?:localhost|127\.0\.0\.1)(?::[0-9]+)?/([A-Za-z0-9_-]+)`
+
+// connectionString is the user, password and database of a connection string tests use
+type connectionString struct {
+	User     string
+	Password string
+	Database string
+	Evidence models.Evidence
+}
+
+// databaseEnvironment returns the environment for a database image, so it creates the user and database tests
+// connect with. They come from the first connection string to a local database in the Makefile or test files,
+// and otherwise are CircleCI 1.0's ubuntu user and circle_test database.
+func databaseEnvironment(dbType string, credentials *databaseCredentials) map[string]string {
+	environment := map[string]string{}
+	user, database, password := CIRCLE_1_DATABASE_USER, CIRCLE_1_DATABASE, ""
+	evidence := models.Evidence{Rule: fmt.Sprintf("CircleCI 1.0 created the %s user and %s database", user, database)}
+	found := findConnectionStrings(dbType, credentials)
+	if len(found) > 0 {
+		first := found[0]
+		if first.User != "" {
+			user = first.User
+		}
+		database, password, evidence = first.Database, first.Password, first.Evidence
+		for _, other := range found[1:] {
+			if (other.User != "" && other.User != user) || other.Database != database {
+				warn(INFO_SEVERITY, MANUAL_FOLLOW_UP_WARNING,
+					fmt.Sprintf("tests connect to %s with more than one user or database -- only %s@%s is created", dbType, user, database),
+					first.Evidence, other.Evidence)
+				break
+			}
+		}
+	}
+
+	environment[credentials.DatabaseEnv] = database
+	if credentials.RootUser != "" && user == credentials.RootUser {
+		// the image creates root itself, and only sets its password from RootPasswordEnv
+		if password != "" {
+			environment[credentials.RootPasswordEnv] = password
+		}
+	} else {
+		environment[credentials.UserEnv] = user
+		if password == "" && credentials.UserNeedsPassword {
+			password = DEFAULT_DATABASE_PASSWORD
+			warn(WARNING_SEVERITY, MANUAL_FOLLOW_UP_WARNING,
+				fmt.Sprintf("the %s image only creates user %s with a password, so %s is set to %s -- tests must connect with it, or as %s",
+					dbType, user, credentials.PasswordEnv, password, credentials.RootUser),
+				evidence)
+		}
+		if password != "" {
+			environment[credentials.PasswordEnv] = password
+		}
+	}
+	// like CircleCI 1.0, connecting as root without a password works, unless tests connect as root with one
+	if credentials.EmptyRootPasswordEnv != "" && environment[credentials.RootPasswordEnv] == "" {
+		environment[credentials.EmptyRootPasswordEnv] = "true"
+	}
+	explainEnvironment(dbType, environment, evidence)
+	return environment
+}
+
+// explainEnvironment explains each variable of a database image's environment, in order
+func explainEnvironment(dbType string, environment map[string]string, evidence models.Evidence) {
+	keys := []string{}
+	for key := range environment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		explain(ENVIRONMENT_DECISION, fmt.Sprintf("%s %s=%s", dbType, key, environment[key]), evidence)
+	}
+}
+
+// findConnectionStrings returns the connection strings to a local database in the Makefile and test files, in that order
+func findConnectionStrings(dbType string, credentials *databaseCredentials) []connectionString {
+	schemes := strings.Join(credentials.Schemes, "|")
+	connectionStringRegexp := regexp.MustCompile(`(?:` + schemes + `)` + connectionStringFormat)
+	rule := func(match []string) string {
+		if match[1] == "" {
+			return fmt.Sprintf("%s connection string uses database %s", dbType, match[3])
+		}
+		return fmt.Sprintf("%s connection string uses user %s and database %s", dbType, match[1], match[3])
+	}
+
+	found := []connectionString{}
+	for _, loc := range connectionStringRegexp.FindAllSubmatchIndex(makefile, -1) {
+		match := []string{}
+		for i := 0; i < len(loc); i += 2 {
+			if loc[i] < 0 {
+				match = append(match, "")
+			} else {
+				match = append(match, string(makefile[loc[i]:loc[i+1]]))
+			}
+		}
+		found = append(found, connectionString{
+			User:     match[1],
+			Password: match[2],
+			Database: match[3],
+			Evidence: models.Evidence{File: "Makefile", Line: lineAt(makefile, loc[0]), Rule: rule(match)},
+		})
+	}
+	for _, line := range searchSourceFileLines(regexp.MustCompile(`(?:`+schemes+`)://`), "", true) {
+		for _, match := range connectionStringRegexp.FindAllStringSubmatch(line.Text, -1) {
+			evidence := line.Evidence
+			evidence.Rule = rule(match)
+			found = append(found, connectionString{
+				User:     match[1],
+				Password: match[2],
+				Database: match[3],
+				Evidence: evidence,
+			})
+		}
+	}
+	return found
+}
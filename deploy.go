@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+const MASTER_BRANCH_GUARD = `[ "${CIRCLE_BRANCH}" = "master" ]`
+const NON_MASTER_BRANCH_GUARD = `[ "${CIRCLE_BRANCH}" != "master" ]`
+
+// BRANCH_BUILD_GUARD fails for tag builds, which have no CIRCLE_BRANCH
+const BRANCH_BUILD_GUARD = `[ -n "${CIRCLE_BRANCH}" ]`
+
+// translateDeploySteps adds a run step for each deployment command, guarded so that it only runs for the
+// deployment's branches, tags and owner. A command in more than one deployment (ignoring whitespace) is added
+// once, with a guard covering all of them.
+func translateDeploySteps(v1 *models.CircleYamlV1, v2 *models.CircleYamlV2) {
+	names := deploymentNames(v1)
+	// once a deployment has a tag trigger the build job also runs for tags, so branch guards must fail for those builds
+	tagBuilds := false
+	for _, name := range names {
+		tagBuilds = tagBuilds || len(v1.Deployment[name].Tag) > 0
+	}
+	branchGuards := map[string]string{}
+	ownerGuards := map[string]string{}
+	// occurrences has the number of times each deployment runs each (normalized) command
+	occurrences := map[string]map[string]int{}
+	for _, name := range names {
+		deployment := v1.Deployment[name]
+		branchGuards[name] = deploymentGuard(name, deployment, tagBuilds)
+		ownerGuards[name] = ownerGuard(deployment)
+		warnForkedPRSecrets(name, deployment)
+		occurrences[name] = map[string]int{}
+		for _, item := range deployment.Commands {
+			occurrences[name][normalizeCommand(item)]++
+		}
+	}
+
+	// added has the number of times each (normalized) command has been added, to match
+	// e.g. a command's second occurrence in one deployment with its second occurrence in another
+	added := map[string]int{}
+	tags := []string{}
+	addedSSHKeys := false
+	for _, name := range names {
+		deployment := v1.Deployment[name]
+		if deployment.Heroku != nil {
+			if !addedSSHKeys {
+				v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, "add_ssh_keys")
+				addedSSHKeys = true
+			}
+			addHerokuDeployStep(v2, name, deployment.Heroku.Appname, joinGuards(branchGuards[name], ownerGuards[name]))
+		}
+		seen := map[string]int{}
+		for _, item := range deployment.Commands {
+			normalized := normalizeCommand(item)
+			seen[normalized]++
+			if seen[normalized] <= added[normalized] {
+				continue
+			}
+			added[normalized]++
+			sharedBy := []string{}
+			for _, other := range names {
+				if occurrences[other][normalized] >= added[normalized] {
+					sharedBy = append(sharedBy, other)
+				}
+			}
+			v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, map[string]string{"run": guardCommand(sharedGuard(sharedBy, branchGuards, ownerGuards, tagBuilds), item)})
+			if len(sharedBy) > 1 {
+				explain(STEP_DECISION, fmt.Sprintf("deploy command `%s` once for deployments %s", item, strings.Join(sharedBy, ", ")),
+					models.Evidence{File: "circle.yml", Line: valueLine(circleCI1File, []string{"deployment", name, "commands"}, item), Rule: "command is in more than one deployment"})
+			}
+		}
+		evidence := []models.Evidence{circleYamlKeyEvidence("deployment." + name)}
+		if deployment.Owner != "" {
+			evidence = append(evidence, circleYamlKeyEvidence(fmt.Sprintf("deployment.%s.owner", name)))
+		}
+		explain(STEP_DECISION, "deploy "+name, evidence...)
+		if deployment.Heroku != nil {
+			explain(STEP_DECISION, "deploy "+name+" to heroku app "+deployment.Heroku.Appname, circleYamlKeyEvidence(fmt.Sprintf("deployment.%s.heroku", name)))
+		}
+		for _, tag := range deployment.Tag {
+			if !contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	if len(tags) > 0 {
+		addTagFilters(v2, tags)
+		explain(STEP_DECISION, "run build job for tags "+strings.Join(tags, ", "), models.Evidence{File: "circle.yml", Rule: "deployment triggered by tag"})
+	}
+}
+
+// addHerokuDeployStep pushes the build to a heroku app's master branch, as CircleCI 1.0 did for a heroku deployment,
+// if guard succeeds. This needs the heroku SSH key from add_ssh_keys, and HEROKU_API_KEY.
+func addHerokuDeployStep(v2 *models.CircleYamlV2, name, appname, guard string) {
+	script := fmt.Sprintf(`if [ -z "${HEROKU_API_KEY}" ]; then echo "HEROKU_API_KEY must be set to deploy to heroku" >&2; exit 1; fi
+mkdir -p ~/.ssh && ssh-keyscan -H heroku.com >> ~/.ssh/known_hosts
+git push --force git@heroku.com:%s.git HEAD:refs/heads/master`, appname)
+	herokuDeployStep := map[string]interface{}{
+		"run": map[string]string{
+			"name":    fmt.Sprintf("Deploy %s to heroku app %s", name, appname),
+			"command": guardCommand(guard, script),
+		},
+	}
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, herokuDeployStep)
+}
+
+// sharedGuard returns a shell test for whether a command shared by deployments runs:
+// -- none if one of the deployments runs for every build
+// -- just their owner guard if two of them, with the same owner, deploy complementary branches (e.g. master and non-master)
+// (and BRANCH_BUILD_GUARD, if the build job also runs for tags)
+// -- otherwise, a test that succeeds if any of their guards do
+func sharedGuard(names []string, branchGuards, ownerGuards map[string]string, tagBuilds bool) string {
+	for _, name := range names {
+		if branchGuards[name] == "" && ownerGuards[name] == "" {
+			return ""
+		}
+	}
+	for _, a := range names {
+		for _, b := range names {
+			if ownerGuards[a] == ownerGuards[b] && complementaryGuards(branchGuards[a], branchGuards[b]) {
+				if tagBuilds {
+					return joinGuards(BRANCH_BUILD_GUARD, ownerGuards[a])
+				}
+				return ownerGuards[a]
+			}
+		}
+	}
+	alternatives := []string{}
+	for _, name := range names {
+		guard := joinGuards(branchGuards[name], ownerGuards[name])
+		if strings.Contains(guard, " && ") && len(names) > 1 {
+			guard = "{ " + guard + "; }"
+		}
+		if !contains(alternatives, guard) {
+			alternatives = append(alternatives, guard)
+		}
+	}
+	return strings.Join(alternatives, " || ")
+}
+
+// complementaryGuards returns true if a tests that the branch is a literal name, and b that it isn't
+// (both after BRANCH_BUILD_GUARD, if they start with it)
+func complementaryGuards(a, b string) bool {
+	a = strings.TrimPrefix(a, BRANCH_BUILD_GUARD+" && ")
+	b = strings.TrimPrefix(b, BRANCH_BUILD_GUARD+" && ")
+	equals := `[ "${CIRCLE_BRANCH}" = `
+	return strings.HasPrefix(a, equals) && b == `[ "${CIRCLE_BRANCH}" != `+strings.TrimPrefix(a, equals)
+}
+
+// normalizeCommand returns command with insignificant whitespace removed, by parsing and printing it as shell
+// (or collapsing all whitespace if it doesn't parse)
+func normalizeCommand(command string) string {
+	if file, err := parseShell(command); err == nil {
+		return printShell(file)
+	}
+	return strings.Join(strings.Fields(command), " ")
+}
+
+// joinGuards returns a shell test that succeeds if all of the non-empty guards do
+func joinGuards(guards ...string) string {
+	nonEmpty := []string{}
+	for _, guard := range guards {
+		if guard != "" {
+			nonEmpty = append(nonEmpty, guard)
+		}
+	}
+	return strings.Join(nonEmpty, " && ")
+}
+
+// ownerGuard returns a shell test for whether the repo being built belongs to the deployment's owner,
+// e.g. so that builds of forks (in their own CircleCI project) don't deploy, or "" if any owner may deploy
+func ownerGuard(deployment models.DeploymentSettings) string {
+	if deployment.Owner == "" {
+		return ""
+	}
+	return `[ "${CIRCLE_PROJECT_USERNAME}" = ` + shellQuote(deployment.Owner) + ` ]`
+}
+
+// secretRegexp matches env vars that are likely secrets, e.g. $DOCKER_PASS or ${GITHUB_TOKEN}
+var secretRegexp = regexp.MustCompile(`\$\{?[A-Z0-9_]*(TOKEN|SECRET|KEY|PASS|CREDENTIAL|AUTH)[A-Z0-9_]*`)
+
+// forkedPRBranch is an example of CIRCLE_BRANCH for a build of a pull request from a fork
+const forkedPRBranch = "pull/123"
+
+// warnForkedPRSecrets warns if a deployment uses secrets and would also run for pull requests from forks.
+// Those builds run in our CircleCI project, so an owner restriction doesn't stop them.
+func warnForkedPRSecrets(name string, deployment models.DeploymentSettings) {
+	if !runsForForkedPRs(name, deployment) {
+		return
+	}
+	secret, evidence := "", models.Evidence{}
+	if deployment.Heroku != nil {
+		secret, evidence = "$HEROKU_API_KEY", circleYamlKeyEvidence(fmt.Sprintf("deployment.%s.heroku", name))
+	}
+	for _, command := range deployment.Commands {
+		if secret != "" {
+			break
+		}
+		if secret = secretRegexp.FindString(command); secret != "" {
+			evidence = models.Evidence{File: "circle.yml", Line: valueLine(circleCI1File, []string{"deployment", name, "commands"}, command), Rule: "deploy command uses " + secret}
+		}
+	}
+	if secret != "" {
+		warn(WARNING_SEVERITY, FORKED_PR_SECRETS_WARNING,
+			fmt.Sprintf("deployment %s uses %s and would run for pull requests from forks -- make sure forked PR builds don't get secrets, or add a [ -z \"${CIRCLE_PR_NUMBER}\" ] guard", name, secret),
+			evidence)
+	}
+}
+
+// runsForForkedPRs returns true if a deployment's branch triggers could match the branch of a forked pull request build
+func runsForForkedPRs(name string, deployment models.DeploymentSettings) bool {
+	if len(deployment.Branch) == 0 {
+		return len(deployment.Tag) == 0 && name != "master"
+	}
+	for _, pattern := range deployment.Branch {
+		if len(pattern) < 2 || !strings.HasPrefix(pattern, "/") || !strings.HasSuffix(pattern, "/") {
+			if pattern == forkedPRBranch {
+				return true
+			}
+			continue
+		}
+		// go doesn't support every java regex feature (e.g. the lookahead in /^(?!master$).*$/), so assume those match
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil || re.MatchString(forkedPRBranch) {
+			return true
+		}
+	}
+	return false
+}
+
+// deploymentNames returns the names of the deployments in circle.yml: non-master and master first
+// (the names most of our repos use), then the rest in alphabetical order
+func deploymentNames(v1 *models.CircleYamlV1) []string {
+	names := []string{}
+	for _, name := range []string{"non-master", "master"} {
+		if _, ok := v1.Deployment[name]; ok {
+			names = append(names, name)
+		}
+	}
+	rest := []string{}
+	for name := range v1.Deployment {
+		if name != "non-master" && name != "master" {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+// deploymentGuard returns a shell test for whether a deployment runs, based on its branch and tag triggers,
+// or "" if it runs for every build. If the build job also runs for tags (tagBuilds), each trigger only matches
+// its own kind of build, since e.g. a negated branch regex also matches the empty CIRCLE_BRANCH of a tag build.
+func deploymentGuard(name string, deployment models.DeploymentSettings, tagBuilds bool) string {
+	if len(deployment.Branch) == 0 && len(deployment.Tag) == 0 {
+		// without a trigger, assume a master or non-master deployment is named for the branches it deploys
+		guard := ""
+		switch name {
+		case "master":
+			guard = MASTER_BRANCH_GUARD
+		case "non-master":
+			guard = NON_MASTER_BRANCH_GUARD
+		}
+		if tagBuilds {
+			return joinGuards(BRANCH_BUILD_GUARD, guard)
+		}
+		return guard
+	}
+
+	branchConditions, branchSimple := patternConditions(name, "CIRCLE_BRANCH", deployment.Branch)
+	tagConditions, tagSimple := patternConditions(name, "CIRCLE_TAG", deployment.Tag)
+	// a literal tag can't match a branch build's empty CIRCLE_TAG
+	if len(branchConditions) == 0 && len(tagConditions) == 1 && tagSimple {
+		return "[ " + tagConditions[0] + " ]"
+	}
+	if len(branchConditions) == 1 && len(tagConditions) == 0 && branchSimple {
+		if tagBuilds {
+			return joinGuards(BRANCH_BUILD_GUARD, "[ "+branchConditions[0]+" ]")
+		}
+		return "[ " + branchConditions[0] + " ]"
+	}
+	if !tagBuilds {
+		return "[[ " + strings.Join(branchConditions, " || ") + " ]]"
+	}
+	alternatives := []string{}
+	for _, kind := range []struct {
+		variable   string
+		conditions []string
+	}{{"CIRCLE_BRANCH", branchConditions}, {"CIRCLE_TAG", tagConditions}} {
+		switch len(kind.conditions) {
+		case 0:
+		case 1:
+			alternatives = append(alternatives, `-n "${`+kind.variable+`}" && `+kind.conditions[0])
+		default:
+			alternatives = append(alternatives, `-n "${`+kind.variable+`}" && ( `+strings.Join(kind.conditions, " || ")+" )")
+		}
+	}
+	return "[[ " + strings.Join(alternatives, " || ") + " ]]"
+}
+
+// patternConditions returns the conditions on an env var for each of a deployment's branch or tag patterns,
+// and whether they're all simple enough for `[ ]` rather than `[[ ]]`
+func patternConditions(deployment, variable string, patterns []string) ([]string, bool) {
+	conditions := []string{}
+	simple := true
+	for _, pattern := range patterns {
+		condition, isSimple := patternCondition(deployment, variable, pattern)
+		conditions = append(conditions, condition)
+		simple = simple && isSimple
+	}
+	return conditions, simple
+}
+
+// negatedRegexp matches the regex v1 configs use to deploy every branch but one, e.g. /^(?!master$).*$/
+var negatedRegexp = regexp.MustCompile(`^\^\(\?!(.+)\$\)\.\*\$?$`)
+
+// javaRegexClasses are the character classes v1 branch regexes (java) support but bash regexes (ERE) don't
+var javaRegexClasses = strings.NewReplacer(`\d`, `[0-9]`, `\D`, `[^0-9]`, `\w`, `[A-Za-z0-9_]`, `\W`, `[^A-Za-z0-9_]`, `\s`, `[[:space:]]`, `\S`, `[^[:space:]]`)
+
+// patternCondition returns a condition on an env var for a branch or tag pattern (a literal name or a /regex/),
+// and whether the condition is simple enough for `[ ]` rather than `[[ ]]`
+func patternCondition(deployment, variable, pattern string) (string, bool) {
+	value := `"${` + variable + `}"`
+	if len(pattern) < 2 || !strings.HasPrefix(pattern, "/") || !strings.HasSuffix(pattern, "/") {
+		return value + " = " + shellQuote(pattern), true
+	}
+
+	re := pattern[1 : len(pattern)-1]
+	negated := false
+	if match := negatedRegexp.FindStringSubmatch(re); match != nil {
+		re = match[1]
+		negated = true
+		if isLiteralPattern(re) {
+			return value + " != " + shellQuote(re), true
+		}
+	}
+	re = javaRegexClasses.Replace(re)
+	if strings.Contains(re, "(?") {
+		warn(WARNING_SEVERITY, MANUAL_FOLLOW_UP_WARNING,
+			fmt.Sprintf("deployment %s pattern %s uses regex features bash doesn't support -- rewrite its guard by hand", deployment, pattern),
+			circleYamlKeyEvidence("deployment."+deployment))
+	}
+	// v1 patterns match the whole branch or tag name
+	re = "^(" + strings.TrimSuffix(strings.TrimPrefix(re, "^"), "$") + ")$"
+	re = strings.Replace(re, " ", `\ `, -1)
+	if negated {
+		return fmt.Sprintf(`! %s =~ %s`, value, re), false
+	}
+	return fmt.Sprintf(`%s =~ %s`, value, re), false
+}
+
+// isLiteralPattern returns true if a regex has no special characters, so matches only itself
+func isLiteralPattern(re string) bool {
+	return !strings.ContainsAny(re, `\.+*?()|[]{}^$`)
+}
+
+// addTagFilters runs the build job for tags as well as branches, which CircleCI 2.0 only does
+// when a workflow filter allows them. Tag patterns use the same syntax in 1.0 and 2.0.
+func addTagFilters(v2 *models.CircleYamlV2, tags []string) {
+	v2.Workflows = &models.Workflows{Version: 2}
+	v2.Workflows.Build.Jobs = []interface{}{
+		map[string]models.WorkflowJob{
+			"build": {Filters: models.Filters{Tags: &models.FilterPatterns{Only: tags}}},
+		},
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
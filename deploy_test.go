@@ -0,0 +1,237 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// runDeploySteps runs the steps translateDeploySteps adds for v1 with bash, with env (e.g. CIRCLE_BRANCH=master)
+// added to the environment, and returns what they print
+func runDeploySteps(t *testing.T, v1 *models.CircleYamlV1, env ...string) []string {
+	v2 := &models.CircleYamlV2{}
+	translateDeploySteps(v1, v2)
+	output := []string{}
+	for _, step := range v2.Jobs.Build.Steps {
+		_, command, ok := runCommand(step)
+		if !ok {
+			continue
+		}
+		output = append(output, strings.Fields(runBash(t, command, env...))...)
+	}
+	return output
+}
+
+// runBash checks that script is valid bash, then runs it with env added to the environment and returns its output
+func runBash(t *testing.T, script string, env ...string) string {
+	if out, err := exec.Command("bash", "-n", "-c", script).CombinedOutput(); err != nil {
+		t.Fatalf("invalid bash: %s\n%s\n%s", err, out, script)
+	}
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Env = append(append(os.Environ(), "CIRCLE_BRANCH=", "CIRCLE_TAG=", "CIRCLE_PROJECT_USERNAME="), env...)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("script failed: %s\n%s", err, script)
+	}
+	return string(out)
+}
+
+func TestTagDeploymentDoesntRunBranchDeployments(t *testing.T) {
+	v1 := &models.CircleYamlV1{Deployment: map[string]models.DeploymentSettings{
+		"master":     {Branch: models.Patterns{"master"}, Commands: []string{"echo master", "echo shared"}},
+		"non-master": {Branch: models.Patterns{"/^(?!master$).*$/"}, Commands: []string{"echo non-master", "echo shared"}},
+		"dev":        {Commands: []string{"echo dev"}},
+		"release":    {Tag: models.Patterns{"/v[0-9.]+/"}, Commands: []string{"echo release"}},
+	}}
+	for _, test := range []struct {
+		branch, tag string
+		expected    []string
+	}{
+		{"master", "", []string{"master", "shared", "dev"}},
+		{"feature", "", []string{"non-master", "shared", "dev"}},
+		{"", "v1.2.0", []string{"release"}},
+		{"", "not-a-release", []string{}},
+	} {
+		output := runDeploySteps(t, v1, "CIRCLE_BRANCH="+test.branch, "CIRCLE_TAG="+test.tag)
+		if !sameWords(output, test.expected) {
+			t.Errorf("branch %q tag %q: expected %v, got %v", test.branch, test.tag, test.expected, output)
+		}
+	}
+}
+
+// sameWords returns true if a and b have the same words, in any order
+func sameWords(a, b []string) bool {
+	count := func(words []string) map[string]int {
+		counts := map[string]int{}
+		for _, word := range words {
+			counts[word]++
+		}
+		return counts
+	}
+	return reflect.DeepEqual(count(a), count(b))
+}
+
+func TestDeploymentGuard(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// deploymentName is the deployment's name, if it isn't name
+		deploymentName string
+		deployment     models.DeploymentSettings
+		tagBuilds      bool
+		// runs and skips are builds, as {CIRCLE_BRANCH, CIRCLE_TAG}, that the deployment should and shouldn't run for
+		runs  [][2]string
+		skips [][2]string
+	}{
+		{
+			name:  "master",
+			runs:  [][2]string{{"master", ""}},
+			skips: [][2]string{{"feature", ""}},
+		},
+		{
+			name:  "non-master",
+			runs:  [][2]string{{"feature", ""}},
+			skips: [][2]string{{"master", ""}},
+		},
+		{
+			name:  "everything",
+			runs:  [][2]string{{"master", ""}, {"feature", ""}},
+			skips: [][2]string{},
+		},
+		{
+			name:       "literal",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{"release"}},
+			runs:       [][2]string{{"release", ""}},
+			skips:      [][2]string{{"releases", ""}, {"master", ""}},
+		},
+		{
+			name:       "special characters",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{"fix-$HOME`x`"}},
+			runs:       [][2]string{{"fix-$HOME`x`", ""}},
+			skips:      [][2]string{{"fix-", ""}},
+		},
+		{
+			name:       "regex",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{"/release-.*/"}},
+			runs:       [][2]string{{"release-1", ""}},
+			skips:      [][2]string{{"release", ""}, {"old-release-1", ""}},
+		},
+		{
+			name:       "anchored regex with java classes",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{`/^feature\d+$/`}},
+			runs:       [][2]string{{"feature12", ""}},
+			skips:      [][2]string{{"featurex", ""}, {"feature12x", ""}},
+		},
+		{
+			name:       "regex with a space",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{"/my branch/"}},
+			runs:       [][2]string{{"my branch", ""}},
+			skips:      [][2]string{{"my", ""}},
+		},
+		{
+			name:       "negated literal",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{"/^(?!master$).*$/"}},
+			runs:       [][2]string{{"feature", ""}},
+			skips:      [][2]string{{"master", ""}},
+		},
+		{
+			name:       "negated regex",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{"/^(?!release-.*$).*$/"}},
+			runs:       [][2]string{{"feature", ""}},
+			skips:      [][2]string{{"release-1", ""}},
+		},
+		{
+			name:       "several branches",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{"master", "/hotfix-.*/"}},
+			runs:       [][2]string{{"master", ""}, {"hotfix-1", ""}},
+			skips:      [][2]string{{"dev", ""}},
+		},
+		{
+			name:       "literal tag",
+			deployment: models.DeploymentSettings{Tag: models.Patterns{"v1"}},
+			tagBuilds:  true,
+			runs:       [][2]string{{"", "v1"}},
+			skips:      [][2]string{{"", "v2"}, {"master", ""}},
+		},
+		{
+			name:       "tag regex",
+			deployment: models.DeploymentSettings{Tag: models.Patterns{"/.*/"}},
+			tagBuilds:  true,
+			runs:       [][2]string{{"", "v1"}},
+			skips:      [][2]string{{"master", ""}},
+		},
+		{
+			name:       "branch and tag",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{"master"}, Tag: models.Patterns{"/v.*/"}},
+			tagBuilds:  true,
+			runs:       [][2]string{{"master", ""}, {"", "v1"}},
+			skips:      [][2]string{{"feature", ""}, {"", "release"}},
+		},
+		{
+			name:       "negated branch in a build with tags",
+			deployment: models.DeploymentSettings{Branch: models.Patterns{"/^(?!master$).*$/"}},
+			tagBuilds:  true,
+			runs:       [][2]string{{"feature", ""}},
+			skips:      [][2]string{{"master", ""}, {"", "v1"}},
+		},
+		{
+			name:           "non-master in a build with tags",
+			deploymentName: "non-master",
+			tagBuilds:      true,
+			runs:           [][2]string{{"feature", ""}},
+			skips:          [][2]string{{"master", ""}, {"", "v1"}},
+		},
+		{
+			name:           "everything in a build with tags",
+			deploymentName: "everything",
+			tagBuilds:      true,
+			runs:           [][2]string{{"feature", ""}},
+			skips:          [][2]string{{"", "v1"}},
+		},
+	} {
+		name := test.name
+		if test.deploymentName != "" {
+			name = test.deploymentName
+		}
+		guard := deploymentGuard(name, test.deployment, test.tagBuilds)
+		script := guardCommand(guard, "echo deploy")
+		for i, build := range append(test.runs, test.skips...) {
+			output := runBash(t, script, "CIRCLE_BRANCH="+build[0], "CIRCLE_TAG="+build[1])
+			expected := ""
+			if i < len(test.runs) {
+				expected = "deploy\n"
+			}
+			if output != expected {
+				t.Errorf("%s: branch %q tag %q: expected %q, got %q from\n%s", test.name, build[0], build[1], expected, output, script)
+			}
+		}
+	}
+}
+
+func TestSharedDeployCommands(t *testing.T) {
+	v1 := &models.CircleYamlV1{Deployment: map[string]models.DeploymentSettings{
+		"master":     {Branch: models.Patterns{"master"}, Owner: "Clever", Commands: []string{"echo master", "echo  both"}},
+		"non-master": {Branch: models.Patterns{"/^(?!master$).*$/"}, Owner: "Clever", Commands: []string{"echo both"}},
+		"staging":    {Branch: models.Patterns{"staging"}, Commands: []string{"echo staging-or-release"}},
+		"release":    {Branch: models.Patterns{"/release-.*/"}, Owner: "Clever", Commands: []string{"echo staging-or-release"}},
+	}}
+	for _, test := range []struct {
+		branch, owner string
+		expected      []string
+	}{
+		{"master", "Clever", []string{"master", "both"}},
+		{"feature", "Clever", []string{"both"}},
+		{"feature", "a-fork", []string{}},
+		{"staging", "a-fork", []string{"staging-or-release"}},
+		{"release-1", "Clever", []string{"both", "staging-or-release"}},
+		{"release-1", "a-fork", []string{}},
+	} {
+		output := runDeploySteps(t, v1, "CIRCLE_BRANCH="+test.branch, "CIRCLE_PROJECT_USERNAME="+test.owner)
+		if !sameWords(output, test.expected) {
+			t.Errorf("branch %q owner %q: expected %v, got %v", test.branch, test.owner, test.expected, output)
+		}
+	}
+}
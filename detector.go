@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+	// for the lines of keys and values, which the Clever yaml fork doesn't expose
+	yamlnode "gopkg.in/yaml.v3"
+)
+
+// RepoContext is what detectors know about the repo being migrated
+// other files are read relative to the working directory, which is the repo's root
+type RepoContext struct {
+	V1         *models.CircleYamlV1
+	Makefile   []byte
+	CircleYaml []byte
+}
+
+// Detector recognizes one app type (go, node, ...) from cues in the repo
+type Detector interface {
+	// AppType is the app type this detector recognizes, e.g. GOLANG_APP_TYPE
+	AppType() string
+	// Detect returns how confident the detector is that the repo is its app type, and why,
+	// or false if the repo is not its app type
+	Detect(repo *RepoContext) (models.AppDetection, bool)
+	// Version returns the language version the repo uses, and why
+	Version(repo *RepoContext) (string, []models.Evidence)
+	// Image returns the primary image for a language version, or false if there is none
+	Image(version string) (models.DockerImage, bool)
+}
+
+// DependencyInstaller is implemented by detectors whose app type had dependency install steps
+// inferred by CircleCI 1.0 (e.g. bundle install). These are added unless circle.yml overrides dependencies.
+type DependencyInstaller interface {
+	AddInstallSteps(v2 *models.CircleYamlV2, version string)
+}
+
+// ServiceDetector recognizes that a repo's tests rely on a service, e.g. a database
+type ServiceDetector interface {
+	// Service is the service this detector recognizes, e.g. POSTGRESQL_DB_TYPE
+	Service() string
+	// Detect returns how confident the detector is that the repo needs its service, and why,
+	// or false if the repo doesn't need it
+	Detect(repo *RepoContext) (models.ServiceDetection, bool)
+}
+
+type registeredDetector struct {
+	priority int
+	detector Detector
+}
+
+type registeredServiceDetector struct {
+	priority int
+	detector ServiceDetector
+}
+
+var (
+	detectors        = []registeredDetector{}
+	serviceDetectors = []registeredServiceDetector{}
+)
+
+// registerDetector adds an app type detector. Detectors run in priority order (lowest first);
+// the most confident detection wins, and ties go to the detector that ran first.
+// Built-in detectors are registered in detectors_app.go; forks can register their own from an init() in a new file.
+func registerDetector(priority int, detector Detector) {
+	detectors = append(detectors, registeredDetector{priority: priority, detector: detector})
+	sort.SliceStable(detectors, func(i, j int) bool {
+		return detectors[i].priority < detectors[j].priority
+	})
+}
+
+// registerServiceDetector adds a service detector. Service detectors run in priority order (lowest first),
+// which is also the order service images are added in.
+// Built-in service detectors are registered in detectors_service.go.
+func registerServiceDetector(priority int, detector ServiceDetector) {
+	serviceDetectors = append(serviceDetectors, registeredServiceDetector{priority: priority, detector: detector})
+	sort.SliceStable(serviceDetectors, func(i, j int) bool {
+		return serviceDetectors[i].priority < serviceDetectors[j].priority
+	})
+}
+
+// appDetector returns the registered detector for an app type, or nil if there is none
+func appDetector(appType string) Detector {
+	for _, registered := range detectors {
+		if registered.detector.AppType() == appType {
+			return registered.detector
+		}
+	}
+	return nil
+}
+
+// determineImageConstraints returns the constraints for the docker images section of build, including:
+// -- app type (wag, go, node, ruby, java, php, haskell, python, unknown), from the most confident detector
+// -- version of  image base language/library (e.g., go "1.10", node "6"), from that detector
+// -- database types needed for tests (e.g., mongo, postgresql), from every service detector that matches
+// -- versions of those (and other) services, e.g. postgresql "9.6"
+func determineImageConstraints(v1 *models.CircleYamlV1) models.ImageConstraints {
+	repo := &RepoContext{
+		V1:         v1,
+		Makefile:   makefile,
+		CircleYaml: circleCI1File,
+	}
+	imageConstraints := models.ImageConstraints{
+		AppType:         UNKNOWN_APP_TYPE,
+		AppTypeEvidence: []models.Evidence{{Rule: "no app type detector matched"}},
+	}
+
+	var best models.AppDetection
+	var bestDetector Detector
+	for _, registered := range detectors {
+		detection, ok := registered.detector.Detect(repo)
+		if ok && detection.Confidence > best.Confidence {
+			best = detection
+			bestDetector = registered.detector
+		}
+	}
+	if bestDetector != nil {
+		version, versionEvidence := bestDetector.Version(repo)
+		imageConstraints = models.ImageConstraints{
+			AppType:         best.AppType,
+			Version:         version,
+			AppTypeEvidence: best.Evidence,
+			VersionEvidence: versionEvidence,
+		}
+	}
+
+	determineDatabaseTypes(repo, &imageConstraints)
+	imageConstraints.DatabaseVersions, imageConstraints.DatabaseVersionEvidence, imageConstraints.DatabaseVersionLimits =
+		determineDatabaseVersions(repo)
+	return imageConstraints
+}
+
+// service sources are where the need for a service came from
+const DETECTED_SERVICE_SOURCE = "detected"
+const MACHINE_SERVICES_SOURCE = "machine.services"
+const ALLOWLIST_SERVICE_SOURCE = "allowlist"
+
+// determineDatabaseTypes adds the database types needed for tests to constraints, from every service detector that matches
+func determineDatabaseTypes(repo *RepoContext, constraints *models.ImageConstraints) {
+	for _, registered := range serviceDetectors {
+		if detection, ok := registered.detector.Detect(repo); ok {
+			addService(constraints, detection.Service, DETECTED_SERVICE_SOURCE, detection.Evidence...)
+		}
+	}
+}
+
+// addService adds a service to constraints' database types, or adds source and evidence to it if it's already there,
+// so each service is attached once however many sources need it
+func addService(constraints *models.ImageConstraints, service, source string, evidence ...models.Evidence) {
+	if constraints.DatabaseTypes == nil {
+		constraints.DatabaseTypes = map[string]struct{}{}
+		constraints.DatabaseEvidence = map[string][]models.Evidence{}
+		constraints.DatabaseSources = map[string][]string{}
+	}
+	constraints.DatabaseTypes[service] = struct{}{}
+	constraints.DatabaseEvidence[service] = append(constraints.DatabaseEvidence[service], evidence...)
+	if !contains(constraints.DatabaseSources[service], source) {
+		constraints.DatabaseSources[service] = append(constraints.DatabaseSources[service], source)
+	}
+}
+
+// applyServiceLists adds allowedServices to constraints, and removes deniedServices from them
+func applyServiceLists(constraints *models.ImageConstraints) {
+	for _, service := range allowedServices {
+		addService(constraints, service, ALLOWLIST_SERVICE_SOURCE, models.Evidence{Rule: "--allow-services " + service})
+	}
+	for _, service := range deniedServices {
+		removeService(constraints, service, "--deny-services")
+	}
+}
+
+// removeService removes a service from constraints' database types, if it's there, because of reason
+func removeService(constraints *models.ImageConstraints, service, reason string) {
+	if _, ok := constraints.DatabaseTypes[service]; !ok {
+		return
+	}
+	fmt.Printf("not attaching %s (%s)\n", service, reason)
+	delete(constraints.DatabaseTypes, service)
+	delete(constraints.DatabaseEvidence, service)
+	delete(constraints.DatabaseSources, service)
+}
+
+// parseServiceList returns the catalog services in a comma-separated list of services,
+// which may use their catalog or machine.services names (e.g. mongo or mongodb)
+func parseServiceList(list string) ([]string, error) {
+	services := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		service := name
+		if _, ok := serviceCatalog[name]; !ok {
+			if service, ok = machineService(name); !ok {
+				return nil, fmt.Errorf("unknown service %q", name)
+			}
+		}
+		if !contains(services, service) {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// orderedDatabaseTypes returns databaseTypes in service detector priority order,
+// followed by any types without a registered detector in alphabetical order
+func orderedDatabaseTypes(databaseTypes map[string]struct{}) []string {
+	ordered := []string{}
+	seen := map[string]bool{}
+	for _, registered := range serviceDetectors {
+		service := registered.detector.Service()
+		if _, ok := databaseTypes[service]; ok && !seen[service] {
+			ordered = append(ordered, service)
+			seen[service] = true
+		}
+	}
+	rest := []string{}
+	for service := range databaseTypes {
+		if !seen[service] {
+			rest = append(rest, service)
+		}
+	}
+	sort.Strings(rest)
+	return append(ordered, rest...)
+}
+
+// fileEvidence returns evidence about a whole file, e.g. that it exists
+func fileEvidence(file, rule string) models.Evidence {
+	return models.Evidence{File: file, Rule: rule}
+}
+
+// existingFileEvidence returns evidence that the first of the given files (or glob patterns) exists,
+// or false if none of them exist
+func existingFileEvidence(patterns ...string) (models.Evidence, bool) {
+	for _, pattern := range patterns {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			return fileEvidence(matches[0], "file exists"), true
+		}
+	}
+	return models.Evidence{}, false
+}
+
+// matchEvidence returns evidence for the first match of re in contents (the contents of file), or false if there is no match
+func matchEvidence(file string, contents []byte, re *regexp.Regexp, rule string) (models.Evidence, bool) {
+	loc := re.FindIndex(contents)
+	if loc == nil {
+		return models.Evidence{}, false
+	}
+	return models.Evidence{File: file, Line: lineAt(contents, loc[0]), Rule: rule}, true
+}
+
+// lineAt returns the 1-based line number of offset in contents
+func lineAt(contents []byte, offset int) int {
+	return bytes.Count(contents[:offset], []byte("\n")) + 1
+}
+
+// keyLine returns the line of the deepest key along path in a yaml file's nested mappings (or 0 if there is none),
+// and whether that is the whole path
+func keyLine(contents []byte, path []string) (int, bool) {
+	line, _, found := findKey(contents, path)
+	return line, found
+}
+
+// valueLine returns the line of the first scalar under path in a yaml file (anywhere, if path is empty) that is
+// exactly value, e.g. a command in a list of commands, or 0 if there is none
+func valueLine(contents []byte, path []string, value string) int {
+	_, node, found := findKey(contents, path)
+	if !found {
+		return 0
+	}
+	return scalarLine(node, value)
+}
+
+// findKey returns the line of the deepest key along path in a yaml file's nested mappings, its value,
+// and whether that is the whole path
+func findKey(contents []byte, path []string) (int, *yamlnode.Node, bool) {
+	var root yamlnode.Node
+	if err := yamlnode.Unmarshal(contents, &root); err != nil || len(root.Content) == 0 {
+		return 0, nil, false
+	}
+	node, line := root.Content[0], 0
+	for _, key := range path {
+		if node.Kind != yamlnode.MappingNode {
+			return line, node, false
+		}
+		found := false
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				line, node, found = node.Content[i].Line, node.Content[i+1], true
+				break
+			}
+		}
+		if !found {
+			return line, node, false
+		}
+	}
+	return line, node, true
+}
+
+// scalarLine returns the line of the first scalar in node (including mapping keys) that is exactly value, or 0
+func scalarLine(node *yamlnode.Node, value string) int {
+	if node.Kind == yamlnode.ScalarNode && node.Value == value {
+		return node.Line
+	}
+	for _, child := range node.Content {
+		if line := scalarLine(child, value); line > 0 {
+			return line
+		}
+	}
+	return 0
+}
+
+// lineContaining returns the 1-based line number of the first occurrence of s in contents, or 0 if there is none
+func lineContaining(contents []byte, s string) int {
+	if s == "" {
+		return 0
+	}
+	offset := bytes.Index(contents, []byte(s))
+	if offset < 0 {
+		return 0
+	}
+	return lineAt(contents, offset)
+}
+
+// readFileSubmatch returns the first submatch of re in file, and the line it is on,
+// or "" if the file or match doesn't exist
+func readFileSubmatch(file string, re *regexp.Regexp) (string, int) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", 0
+	}
+	return submatch(contents, re)
+}
+
+// submatch returns the first submatch of re in contents, and the line it is on, or "" if there is no match
+func submatch(contents []byte, re *regexp.Regexp) (string, int) {
+	match := re.FindSubmatchIndex(contents)
+	if match == nil || match[2] < 0 {
+		return "", 0
+	}
+	return string(bytes.TrimSpace(contents[match[2]:match[3]])), lineAt(contents, match[2])
+}
+
+// fileExists returns true if any of the given files (or glob patterns) exist in the repo
+func fileExists(patterns ...string) bool {
+	_, ok := existingFileEvidence(patterns...)
+	return ok
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// built-in app type detectors
+// confidences decrease with priority, so that when several match the result is the same as checking, in order:
+// package.json, swagger.yml, golang.mk, node.mk, Gemfile, pom.xml/build.gradle, composer.json, stack.yaml/*.cabal,
+// python project files, and finally python commands in the Makefile
+func init() {
+	registerDetector(10, nodeDetector{})
+	registerDetector(20, wagDetector{})
+	registerDetector(30, golangDetector{})
+	registerDetector(40, rubyDetector{})
+	registerDetector(50, javaDetector{})
+	registerDetector(60, phpDetector{})
+	registerDetector(70, haskellDetector{})
+	registerDetector(80, pythonDetector{})
+}
+
+var golangImageMap = map[string]models.DockerImage{
+	"1.10": models.DockerImage{Image: "circleci/golang:1.10.3-stretch"}, // "circleci/golang@sha256:4614481a383e55eef504f26f383db1329c285099fde0cfd342c49e5bb9b6c32a"
+	"1.9":  models.DockerImage{Image: "circleci/golang:1.9.7-stretch"},  // "circleci/golang@sha256:c46bee0b60747525d354f219083a46e06c68152f90f3bfb2812d1f232e6a5097"
+	"1.8":  models.DockerImage{Image: "circleci/golang:1.8.7-stretch"},
+}
+
+// golangDetector detects go apps, which have golang.mk (but this is clever-specific)
+type golangDetector struct{}
+
+func (golangDetector) AppType() string { return GOLANG_APP_TYPE }
+
+func (golangDetector) Detect(repo *RepoContext) (models.AppDetection, bool) {
+	return detectFiles(GOLANG_APP_TYPE, 0.8, "golang.mk")
+}
+
+func (golangDetector) Version(repo *RepoContext) (string, []models.Evidence) {
+	return determineGoVersion(repo)
+}
+
+func (golangDetector) Image(version string) (models.DockerImage, bool) {
+	image, ok := golangImageMap[version]
+	return image, ok
+}
+
+// wagDetector detects wag apps, which are go with node and have a swagger.yml
+type wagDetector struct{}
+
+func (wagDetector) AppType() string { return WAG_APP_TYPE }
+
+func (wagDetector) Detect(repo *RepoContext) (models.AppDetection, bool) {
+	return detectFiles(WAG_APP_TYPE, 0.8, "swagger.yml")
+}
+
+func (wagDetector) Version(repo *RepoContext) (string, []models.Evidence) {
+	return determineGoVersion(repo)
+}
+
+func (wagDetector) Image(version string) (models.DockerImage, bool) {
+	golangBaseImage, ok := golangImageMap[version]
+	if !ok {
+		return models.DockerImage{}, false
+	}
+	//@TODO: -node version not actually availabe for go 1.8
+	return models.DockerImage{Image: fmt.Sprintf("%s-node", golangBaseImage.Image)}, true
+}
+
+// determineGoVersion determines version of go in use for an app
+// this information is in makefile's golang-version-check, e.g.:
+// $(eval $(call golang-version-check,1.10))
+// uses 1.10 as default if version is not found in this way
+func determineGoVersion(repo *RepoContext) (string, []models.Evidence) {
+	versionCheckRegexp := regexp.MustCompile(`golang-version-check,([0-1].[0-9]+)`)
+	version, line := submatch(repo.Makefile, versionCheckRegexp)
+	if version == "" {
+		return "1.10", []models.Evidence{{Rule: "default go version 1.10"}}
+	}
+	return version, []models.Evidence{{File: "Makefile", Line: line, Rule: "golang-version-check " + version}}
+}
+
+// nodeDetector detects node apps, which will have package.json and node.mk (but this is clever-specific) in main project dir
+type nodeDetector struct{}
+
+func (nodeDetector) AppType() string { return NODE_APP_TYPE }
+
+func (nodeDetector) Detect(repo *RepoContext) (models.AppDetection, bool) {
+	if detection, ok := detectFiles(NODE_APP_TYPE, 0.9, "package.json"); ok {
+		return detection, true
+	}
+	return detectFiles(NODE_APP_TYPE, 0.7, "node.mk")
+}
+
+// Version determines version of node for an app, checking these sources in order:
+// -- NODE_VERSION in the Makefile, e.g. NODE_VERSION := "v8"
+// -- .nvmrc
+// -- engines.node in package.json
+// -- the node base image in the Dockerfile
+// -- machine.node.version in circle.yml
+// -- `nvm install` or `nvm use` commands in circle.yml
+// uses 8 as default if version is not found in any of these ways
+func (nodeDetector) Version(repo *RepoContext) (string, []models.Evidence) {
+	return pickVersion("node", findNodeVersions(repo), "8")
+}
+
+func (nodeDetector) Image(version string) (models.DockerImage, bool) {
+	nodeImageMap := map[string]models.DockerImage{
+		"10": models.DockerImage{Image: "circleci/node:10.8.0-stretch"},
+		"8":  models.DockerImage{Image: "circleci/node:8.11.3-stretch"},
+		"6":  models.DockerImage{Image: "circleci/node:6.14.3-stretch"},
+		"5":  models.DockerImage{Image: "circleci/node:6.14.3-stretch"},
+		"4":  models.DockerImage{Image: "circleci/node:6.14.3-stretch"},
+		"0":  models.DockerImage{Image: "circleci/node:6.14.3-stretch"},
+	}
+	image, ok := nodeImageMap[version]
+	if !ok {
+		fmt.Printf("unrecognized node version !%s!\n", version)
+	}
+	return image, ok
+}
+
+// findNodeVersions returns every node major version declared in the repo, in order of precedence
+func findNodeVersions(repo *RepoContext) []versionSource {
+	candidates := []versionCandidate{
+		makefileCandidate(repo, `NODE_VERSION := "(v[0-9.]+)"`, "NODE_VERSION"),
+		fileCandidate(".nvmrc", `(?s)^\s*(\S+)`, "nvm version"),
+	}
+
+	if packageJSON, err := ioutil.ReadFile("package.json"); err == nil {
+		var pkg struct {
+			Engines map[string]string `json:"engines"`
+		}
+		if err := json.Unmarshal(packageJSON, &pkg); err != nil {
+			warn(WARNING_SEVERITY, DETECTION_FAILED_WARNING, fmt.Sprintf("error reading engines in package.json: %s", err.Error()))
+		} else if node := pkg.Engines["node"]; node != "" {
+			candidates = append(candidates, versionCandidate{
+				raw:      node,
+				evidence: models.Evidence{File: "package.json", Line: lineContaining(packageJSON, node), Rule: "engines.node"},
+			})
+		}
+	}
+
+	candidates = append(candidates,
+		fileCandidate("Dockerfile", `[a-z]*\/?node[a-z]*:([0-9][0-9.]*)`, "node base image"),
+		circleYamlCandidate(repo, repo.V1.Machine.Node.Version, "machine.node.version"),
+	)
+
+	nvmCommandRegexp := regexp.MustCompile(`\bnvm (?:install|use) +([^ ;&|]+)`)
+	for _, command := range v1Commands(repo.V1) {
+		if nvmCommand := nvmCommandRegexp.FindStringSubmatch(command); nvmCommand != nil {
+			candidates = append(candidates, circleYamlCommandCandidate(repo, nvmCommand[1], command))
+		}
+	}
+
+	return findVersions("node", nodeMajorVersion, candidates...)
+}
+
+// nodeLTSCodenames maps the codenames accepted by nvm (e.g. `nvm install lts/carbon`) to major versions
+var nodeLTSCodenames = map[string]string{
+	"argon":   "4",
+	"boron":   "6",
+	"carbon":  "8",
+	"dubnium": "10",
+}
+
+// nodeVersionAliases maps nvm's aliases for the newest versions (e.g. `nvm install node`) to major versions
+var nodeVersionAliases = map[string]string{
+	"node":   "10",
+	"stable": "10",
+	"lts/*":  "10",
+}
+
+// nodeMajorVersion returns the major version from a node version or semver range,
+// e.g. "v8.11.3" -> "8", ">=6.0.0" -> "6", "^10" -> "10", "lts/carbon" -> "8", "node" -> "10", "0.10" -> "0"
+func nodeMajorVersion(raw string) (string, bool) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if version, ok := nodeVersionAliases[raw]; ok {
+		return version, true
+	}
+	if strings.HasPrefix(raw, "lts/") {
+		version, ok := nodeLTSCodenames[strings.TrimPrefix(raw, "lts/")]
+		return version, ok
+	}
+	majorVersionRegexp := regexp.MustCompile(`^[\^~>=< ]*v?([0-9]+)`)
+	majorVersion := majorVersionRegexp.FindStringSubmatch(raw)
+	if majorVersion == nil {
+		return "", false
+	}
+	v, err := strconv.Atoi(majorVersion[1])
+	if err != nil {
+		return "", false
+	}
+	return strconv.Itoa(v), true
+}
+
+// pythonProjectFiles are files whose presence marks a repo as a python app
+var pythonProjectFiles = []string{"setup.py", "Pipfile", "tox.ini", ".python-version", "runtime.txt", "requirements*.txt"}
+
+// pythonDetector detects python apps, based on these criteria:
+// -- any of pythonProjectFiles exist
+// -- the Makefile contains the text `pylint`, `python` or `pep8` (less confident)
+type pythonDetector struct{}
+
+func (pythonDetector) AppType() string { return PYTHON_APP_TYPE }
+
+func (pythonDetector) Detect(repo *RepoContext) (models.AppDetection, bool) {
+	if detection, ok := detectFiles(PYTHON_APP_TYPE, 0.6, pythonProjectFiles...); ok {
+		return detection, true
+	}
+	pythonCheckRegexp := regexp.MustCompile(`pylint|python|pep8`)
+	if evidence, ok := matchEvidence("Makefile", repo.Makefile, pythonCheckRegexp, "mentions pylint, python or pep8"); ok {
+		return models.AppDetection{AppType: PYTHON_APP_TYPE, Confidence: 0.3, Evidence: []models.Evidence{evidence}}, true
+	}
+	return models.AppDetection{}, false
+}
+
+// Version determines the major.minor version of python for an app, checking these sources in order:
+// -- .python-version (pyenv)
+// -- runtime.txt, e.g. python-3.6.5
+// -- python_version in Pipfile
+// -- python_requires in setup.py
+// -- the first pyXY environment in tox.ini's envlist
+// -- machine.python.version in circle.yml
+// uses 2.7 as default if version is not found in any of these ways
+func (pythonDetector) Version(repo *RepoContext) (string, []models.Evidence) {
+	toxEnv := fileCandidate("tox.ini", `(?m)^envlist *=.*?\bpy([23][0-9])`, "first envlist environment")
+	if len(toxEnv.raw) == 2 {
+		toxEnv.raw = toxEnv.raw[:1] + "." + toxEnv.raw[1:]
+	}
+	sources := findVersions("python", minorVersion,
+		fileCandidate(".python-version", `(?s)^\s*(\S+)`, "pyenv version"),
+		fileCandidate("runtime.txt", `(?s)^\s*(\S+)`, "python runtime"),
+		fileCandidate("Pipfile", `python_(?:full_)?version *= *"([^"]+)"`, "python_version"),
+		fileCandidate("setup.py", `python_requires *= *['"]([^'"]+)['"]`, "python_requires"),
+		toxEnv,
+		circleYamlCandidate(repo, repo.V1.Machine.Python.Version, "machine.python.version"),
+	)
+	return pickVersion("python", sources, "2.7")
+}
+
+func (pythonDetector) Image(version string) (models.DockerImage, bool) {
+	pythonImageMap := map[string]models.DockerImage{
+		"3.7": models.DockerImage{Image: "circleci/python:3.7.0-stretch"},
+		"3.6": models.DockerImage{Image: "circleci/python:3.6.6-stretch"},
+		"3.5": models.DockerImage{Image: "circleci/python:3.5.5-stretch"},
+		"3.4": models.DockerImage{Image: "circleci/python:3.4.8-stretch"},
+		"2.7": models.DockerImage{Image: "circleci/python:2.7.15"},
+	}
+	image, ok := pythonImageMap[version]
+	return image, ok
+}
+
+func (pythonDetector) AddInstallSteps(v2 *models.CircleYamlV2, version string) {
+	addPythonInstallSteps(v2, version)
+}
+
+// rubyDetector detects ruby apps, which have a Gemfile
+type rubyDetector struct{}
+
+func (rubyDetector) AppType() string { return RUBY_APP_TYPE }
+
+func (rubyDetector) Detect(repo *RepoContext) (models.AppDetection, bool) {
+	return detectFiles(RUBY_APP_TYPE, 0.6, "Gemfile")
+}
+
+// Version determines the major.minor version of ruby for an app, checking these sources in order:
+// -- .ruby-version
+// -- the ruby directive in the Gemfile, e.g. ruby '2.4.1'
+// -- machine.ruby.version in circle.yml
+// uses 2.4 as default if version is not found in any of these ways
+func (rubyDetector) Version(repo *RepoContext) (string, []models.Evidence) {
+	sources := findVersions("ruby", minorVersion,
+		fileCandidate(".ruby-version", `(?s)^\s*(\S+)`, "ruby version"),
+		fileCandidate("Gemfile", `(?m)^ *ruby +['"]([^'"]+)['"]`, "ruby directive"),
+		circleYamlCandidate(repo, repo.V1.Machine.Ruby.Version, "machine.ruby.version"),
+	)
+	return pickVersion("ruby", sources, "2.4")
+}
+
+func (rubyDetector) Image(version string) (models.DockerImage, bool) {
+	rubyImageMap := map[string]models.DockerImage{
+		"2.5": models.DockerImage{Image: "circleci/ruby:2.5.1-stretch"},
+		"2.4": models.DockerImage{Image: "circleci/ruby:2.4.4-stretch"},
+		"2.3": models.DockerImage{Image: "circleci/ruby:2.3.7-stretch"},
+	}
+	image, ok := rubyImageMap[version]
+	return image, ok
+}
+
+func (rubyDetector) AddInstallSteps(v2 *models.CircleYamlV2, version string) {
+	addBundleInstallSteps(v2)
+}
+
+// javaDetector detects java apps, which have a pom.xml (maven) or build.gradle (gradle)
+type javaDetector struct{}
+
+func (javaDetector) AppType() string { return JAVA_APP_TYPE }
+
+func (javaDetector) Detect(repo *RepoContext) (models.AppDetection, bool) {
+	return detectFiles(JAVA_APP_TYPE, 0.6, "pom.xml", "build.gradle")
+}
+
+// Version determines the major version of java for an app, checking these sources in order:
+// -- maven.compiler.source or java.version in pom.xml
+// -- sourceCompatibility in build.gradle
+// -- machine.java.version in circle.yml, e.g. oraclejdk8
+// uses 8 as default if version is not found in any of these ways
+func (javaDetector) Version(repo *RepoContext) (string, []models.Evidence) {
+	sources := findVersions("java", javaMajorVersion,
+		fileCandidate("pom.xml", `<(?:maven\.compiler\.source|java\.version)>([^<]+)<`, "java source version"),
+		fileCandidate("build.gradle", sourceCompatibilityPattern, "sourceCompatibility"),
+		circleYamlCandidate(repo, repo.V1.Machine.Java.Version, "machine.java.version"),
+	)
+	return pickVersion("java", sources, "8")
+}
+
+func (javaDetector) Image(version string) (models.DockerImage, bool) {
+	javaImageMap := map[string]models.DockerImage{
+		"11": models.DockerImage{Image: "circleci/openjdk:11-jdk"},
+		"10": models.DockerImage{Image: "circleci/openjdk:10-jdk"},
+		"8":  models.DockerImage{Image: "circleci/openjdk:8-jdk"},
+	}
+	image, ok := javaImageMap[version]
+	return image, ok
+}
+
+func (javaDetector) AddInstallSteps(v2 *models.CircleYamlV2, version string) {
+	addJavaInstallSteps(v2)
+}
+
+// sourceCompatibilityPattern matches the java version in build.gradle, e.g. sourceCompatibility = '1.8'
+// or sourceCompatibility = JavaVersion.VERSION_1_8
+const sourceCompatibilityPattern = `sourceCompatibility *= *['"]?(?:JavaVersion\.)?(VERSION_[0-9_]+|[0-9.]+)`
+
+// javaMajorVersion returns the major version from a java version or JDK name,
+// e.g. "1.8" -> "8", "oraclejdk8" -> "8", "VERSION_1_8" -> "8", "11" -> "11"
+func javaMajorVersion(raw string) (string, bool) {
+	majorVersionRegexp := regexp.MustCompile(`(?:^|[^0-9._])(?:1[._])?([0-9]+)`)
+	majorVersion := majorVersionRegexp.FindStringSubmatch(strings.TrimPrefix(raw, "VERSION_"))
+	if majorVersion == nil {
+		return "", false
+	}
+	return majorVersion[1], true
+}
+
+// phpDetector detects php apps, which have a composer.json
+type phpDetector struct{}
+
+func (phpDetector) AppType() string { return PHP_APP_TYPE }
+
+func (phpDetector) Detect(repo *RepoContext) (models.AppDetection, bool) {
+	return detectFiles(PHP_APP_TYPE, 0.6, "composer.json")
+}
+
+// Version determines the major.minor version of php for an app, checking these sources in order:
+// -- require.php in composer.json, e.g. ">=7.1"
+// -- machine.php.version in circle.yml
+// uses 7.2 as default if version is not found in any of these ways
+func (phpDetector) Version(repo *RepoContext) (string, []models.Evidence) {
+	candidates := []versionCandidate{}
+	if composerJSON, err := ioutil.ReadFile("composer.json"); err == nil {
+		var composer struct {
+			Require map[string]string `json:"require"`
+		}
+		if err := json.Unmarshal(composerJSON, &composer); err != nil {
+			warn(WARNING_SEVERITY, DETECTION_FAILED_WARNING, fmt.Sprintf("error reading require in composer.json: %s", err.Error()))
+		} else if php := composer.Require["php"]; php != "" {
+			candidates = append(candidates, versionCandidate{
+				raw:      php,
+				evidence: models.Evidence{File: "composer.json", Line: lineContaining(composerJSON, php), Rule: "require.php"},
+			})
+		}
+	}
+	candidates = append(candidates, circleYamlCandidate(repo, repo.V1.Machine.PHP.Version, "machine.php.version"))
+	return pickVersion("php", findVersions("php", minorVersion, candidates...), "7.2")
+}
+
+func (phpDetector) Image(version string) (models.DockerImage, bool) {
+	phpImageMap := map[string]models.DockerImage{
+		"7.2": models.DockerImage{Image: "circleci/php:7.2-cli"},
+		"7.1": models.DockerImage{Image: "circleci/php:7.1-cli"},
+		"7.0": models.DockerImage{Image: "circleci/php:7.0-cli"},
+		"5.6": models.DockerImage{Image: "circleci/php:5.6-cli"},
+	}
+	image, ok := phpImageMap[version]
+	return image, ok
+}
+
+func (phpDetector) AddInstallSteps(v2 *models.CircleYamlV2, version string) {
+	addComposerInstallSteps(v2)
+}
+
+// haskellDetector detects haskell apps, which have a stack.yaml (stack) or *.cabal (cabal)
+type haskellDetector struct{}
+
+func (haskellDetector) AppType() string { return HASKELL_APP_TYPE }
+
+func (haskellDetector) Detect(repo *RepoContext) (models.AppDetection, bool) {
+	return detectFiles(HASKELL_APP_TYPE, 0.6, "stack.yaml", "*.cabal")
+}
+
+// stackageGHCVersions maps stackage LTS resolver major versions to the GHC version they use
+var stackageGHCVersions = map[string]string{
+	"12": "8.4",
+	"11": "8.2",
+	"10": "8.0",
+	"9":  "8.0",
+	"8":  "8.0",
+	"7":  "8.0",
+	"6":  "7.10",
+	"5":  "7.10",
+	"4":  "7.10",
+	"3":  "7.10",
+}
+
+// Version determines the major.minor version of GHC for a haskell app, checking these sources in order:
+// -- the resolver in stack.yaml, e.g. lts-11.22 or ghc-8.2.2
+// -- machine.ghc.version in circle.yml
+// uses 8.4 as default if version is not found in any of these ways
+func (haskellDetector) Version(repo *RepoContext) (string, []models.Evidence) {
+	sources := findVersions("ghc", ghcVersion,
+		fileCandidate("stack.yaml", `(?m)^resolver: *(\S+)`, "resolver"),
+		circleYamlCandidate(repo, repo.V1.Machine.GHC.Version, "machine.ghc.version"),
+	)
+	return pickVersion("ghc", sources, "8.4")
+}
+
+func (haskellDetector) Image(version string) (models.DockerImage, bool) {
+	haskellImageMap := map[string]models.DockerImage{
+		"8.4":  models.DockerImage{Image: "haskell:8.4"},
+		"8.2":  models.DockerImage{Image: "haskell:8.2"},
+		"8.0":  models.DockerImage{Image: "haskell:8.0"},
+		"7.10": models.DockerImage{Image: "haskell:7.10"},
+	}
+	image, ok := haskellImageMap[version]
+	return image, ok
+}
+
+func (haskellDetector) AddInstallSteps(v2 *models.CircleYamlV2, version string) {
+	addHaskellInstallSteps(v2)
+}
+
+// ghcVersion returns the major.minor GHC version from a GHC version or stack resolver,
+// e.g. "7.10.3" -> "7.10", "lts-11.22" -> "8.2", "ghc-8.0.2" -> "8.0"
+func ghcVersion(raw string) (string, bool) {
+	ltsRegexp := regexp.MustCompile(`^lts-([0-9]+)`)
+	if lts := ltsRegexp.FindStringSubmatch(raw); lts != nil {
+		version, ok := stackageGHCVersions[lts[1]]
+		return version, ok
+	}
+	return minorVersion(raw)
+}
+
+// detectFiles returns a detection of appType with the given confidence if any of the given files (or glob patterns) exist
+func detectFiles(appType string, confidence float64, patterns ...string) (models.AppDetection, bool) {
+	evidence, ok := existingFileEvidence(patterns...)
+	if !ok {
+		return models.AppDetection{}, false
+	}
+	return models.AppDetection{AppType: appType, Confidence: confidence, Evidence: []models.Evidence{evidence}}, true
+}
+
+// versionSource is a language version found in the repo, and where it was found
+type versionSource struct {
+	version  string
+	evidence models.Evidence
+}
+
+// versionCandidate is an unparsed language version found in the repo, and where it was found
+// raw is "" if the source doesn't exist or doesn't declare a version
+type versionCandidate struct {
+	raw      string
+	evidence models.Evidence
+}
+
+// fileCandidate returns the first submatch of pattern in file as a version candidate
+func fileCandidate(file, pattern, rule string) versionCandidate {
+	raw, line := readFileSubmatch(file, regexp.MustCompile(pattern))
+	return versionCandidate{raw: raw, evidence: models.Evidence{File: file, Line: line, Rule: rule}}
+}
+
+// makefileCandidate returns the first submatch of pattern in the Makefile as a version candidate
+func makefileCandidate(repo *RepoContext, pattern, rule string) versionCandidate {
+	raw, line := submatch(repo.Makefile, regexp.MustCompile(pattern))
+	return versionCandidate{raw: raw, evidence: models.Evidence{File: "Makefile", Line: line, Rule: rule}}
+}
+
+// circleYamlCandidate returns the version at key (e.g. machine.node.version) in circle.yml as a version candidate
+func circleYamlCandidate(repo *RepoContext, raw, key string) versionCandidate {
+	line, _ := keyLine(repo.CircleYaml, strings.Split(key, "."))
+	return versionCandidate{raw: raw, evidence: models.Evidence{File: "circle.yml", Line: line, Rule: key}}
+}
+
+// circleYamlCommandCandidate returns a version in a circle.yml command (e.g. nvm install 6) as a version candidate
+func circleYamlCommandCandidate(repo *RepoContext, raw, command string) versionCandidate {
+	return versionCandidate{raw: raw, evidence: circleYamlCommandEvidence(repo.CircleYaml, command, fmt.Sprintf("command `%s`", command))}
+}
+
+// circleYamlCommandEvidence returns evidence pointing at a command in circle.yml
+func circleYamlCommandEvidence(circleYaml []byte, command, rule string) models.Evidence {
+	return models.Evidence{File: "circle.yml", Line: valueLine(circleYaml, nil, command), Rule: rule}
+}
+
+// findVersions returns the versions that parse finds in each candidate, in order
+func findVersions(language string, parse func(string) (string, bool), candidates ...versionCandidate) []versionSource {
+	found := []versionSource{}
+	for _, candidate := range candidates {
+		if candidate.raw == "" {
+			continue
+		}
+		if version, ok := parse(candidate.raw); ok {
+			evidence := candidate.evidence
+			evidence.Rule = fmt.Sprintf("%s %s", evidence.Rule, candidate.raw)
+			found = append(found, versionSource{version: version, evidence: evidence})
+		} else {
+			warn(INFO_SEVERITY, UNRECOGNIZED_VERSION_WARNING,
+				fmt.Sprintf("unrecognized %s version %q in %s", language, candidate.raw, candidate.evidence), candidate.evidence)
+		}
+	}
+	return found
+}
+
+// pickVersion returns the version from the first source, or defaultVersion if there are no sources
+// prints a warning for each source that disagrees with the chosen version
+func pickVersion(language string, sources []versionSource, defaultVersion string) (string, []models.Evidence) {
+	if len(sources) == 0 {
+		fmt.Printf("using default %s version\n", language)
+		return defaultVersion, []models.Evidence{{Rule: fmt.Sprintf("default %s version %s", language, defaultVersion)}}
+	}
+
+	chosen := sources[0]
+	for _, source := range sources[1:] {
+		if source.version != chosen.version {
+			warn(WARNING_SEVERITY, VERSION_CONFLICT_WARNING,
+				fmt.Sprintf("conflicting %s versions: %s says %s, %s says %s -- using %s",
+					language, chosen.evidence, chosen.version, source.evidence, source.version, chosen.version),
+				chosen.evidence, source.evidence)
+		}
+	}
+	return chosen.version, []models.Evidence{chosen.evidence}
+}
+
+// minorVersion returns the major.minor version from a language version or specifier,
+// e.g. "3.6.5" -> "3.6", "python-2.7.15" -> "2.7", ">=7.1" -> "7.1", "ruby-2.4.1" -> "2.4"
+func minorVersion(raw string) (string, bool) {
+	minorVersionRegexp := regexp.MustCompile(`(?:^|[^0-9.])([0-9]+)\.([0-9]+)`)
+	minorVersion := minorVersionRegexp.FindStringSubmatch(raw)
+	if minorVersion == nil {
+		return "", false
+	}
+	return minorVersion[1] + "." + minorVersion[2], true
+}
+
+// v1Commands returns every command in the v1 phases, in the order CircleCI 1.0 ran them
+func v1Commands(v1 *models.CircleYamlV1) []string {
+	commands := []string{}
+	commands = append(commands, v1.Machine.Pre...)
+	commands = append(commands, v1.Machine.Post...)
+	for _, phase := range []models.Phase{v1.Checkout, v1.Dependencies, v1.Database, v1.Compile, v1.Test} {
+		commands = append(commands, phase.Pre...)
+		commands = append(commands, phase.Override...)
+		commands = append(commands, phase.Post...)
+	}
+	return commands
+}
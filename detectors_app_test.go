@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Clever/circle-v2-migrate/models"
+	"github.com/Clever/yaml"
+)
+
+func TestJavaMajorVersion(t *testing.T) {
+	sourceCompatibilityRegexp := regexp.MustCompile(sourceCompatibilityPattern)
+	for _, test := range []struct {
+		gradle   string
+		raw      string
+		expected string
+	}{
+		{gradle: "sourceCompatibility = 1.8", expected: "8"},
+		{gradle: "sourceCompatibility = '1.8'", expected: "8"},
+		{gradle: "sourceCompatibility = JavaVersion.VERSION_1_8", expected: "8"},
+		{gradle: "sourceCompatibility = JavaVersion.VERSION_11", expected: "11"},
+		{gradle: "sourceCompatibility = VERSION_11", expected: "11"},
+		{raw: "oraclejdk8", expected: "8"},
+		{raw: "openjdk11", expected: "11"},
+		{raw: "11", expected: "11"},
+	} {
+		raw := test.raw
+		if test.gradle != "" {
+			match := sourceCompatibilityRegexp.FindStringSubmatch(test.gradle)
+			if match == nil {
+				t.Errorf("%q: sourceCompatibility not found", test.gradle)
+				continue
+			}
+			raw = match[1]
+		}
+		if version, ok := javaMajorVersion(raw); !ok || version != test.expected {
+			t.Errorf("%q: expected %s, got %q (ok %v)", test.gradle+test.raw, test.expected, version, ok)
+		}
+	}
+}
+
+func TestNodeMajorVersion(t *testing.T) {
+	for _, test := range []struct {
+		raw      string
+		expected string
+		ok       bool
+	}{
+		{"v8.11.3", "8", true},
+		{"8", "8", true},
+		{">=6.0.0", "6", true},
+		{"^10", "10", true},
+		{"~ 4.2", "4", true},
+		{"0.10", "0", true},
+		{"lts/carbon", "8", true},
+		{"lts/*", "10", true},
+		{"node", "10", true},
+		{"lts/hydrogen", "", false},
+		{"iojs", "", false},
+	} {
+		if version, ok := nodeMajorVersion(test.raw); version != test.expected || ok != test.ok {
+			t.Errorf("%q: expected %q (ok %v), got %q (ok %v)", test.raw, test.expected, test.ok, version, ok)
+		}
+	}
+}
+
+func TestMinorVersion(t *testing.T) {
+	for _, test := range []struct {
+		raw      string
+		expected string
+		ok       bool
+	}{
+		{"3.6.5", "3.6", true},
+		{"3.6.5/envs/x", "3.6", true},
+		{"python-2.7.15", "2.7", true},
+		{">=3.5", "3.5", true},
+		{"ruby-2.4.1", "2.4", true},
+		{"3", "", false},
+		{"system", "", false},
+	} {
+		if version, ok := minorVersion(test.raw); version != test.expected || ok != test.ok {
+			t.Errorf("%q: expected %q (ok %v), got %q (ok %v)", test.raw, test.expected, test.ok, version, ok)
+		}
+	}
+}
+
+// writeFiles writes each file (keyed by name) in the current directory
+func writeFiles(t *testing.T, files map[string]string) {
+	for name, contents := range files {
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNodeVersion(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		files     map[string]string
+		circleYml string
+		expected  string
+		// rule is the start of the chosen evidence's rule
+		rule string
+	}{
+		{name: "default", expected: "8", rule: "default node version"},
+		{name: ".nvmrc", files: map[string]string{".nvmrc": "v6.14.3\n"}, expected: "6", rule: "nvm version"},
+		{name: "engines", files: map[string]string{"package.json": `{"engines": {"node": ">=10.0.0"}}`}, expected: "10", rule: "engines.node"},
+		{
+			name:     ".nvmrc before engines",
+			files:    map[string]string{".nvmrc": "lts/boron", "package.json": `{"engines": {"node": "^8"}}`},
+			expected: "6",
+			rule:     "nvm version",
+		},
+		{name: "nvm install", circleYml: "machine:\n  pre:\n    - nvm install 6 && nvm alias default 6\n", expected: "6", rule: "command `nvm install 6"},
+		{name: "nvm use", circleYml: "test:\n  pre:\n    - nvm use v10.8.0; npm test\n", expected: "10", rule: "command `nvm use v10.8.0"},
+		{name: "nvm install node", circleYml: "dependencies:\n  pre:\n    - nvm install node\n", expected: "10", rule: "command `nvm install node"},
+		{name: "nvm install lts/*", circleYml: "dependencies:\n  pre:\n    - nvm install lts/*\n", expected: "10", rule: "command `nvm install lts/*"},
+	} {
+		inTempDir(t, func() {
+			writeFiles(t, test.files)
+			v1 := models.CircleYamlV1{}
+			if err := yaml.Unmarshal([]byte(test.circleYml), &v1); err != nil {
+				t.Fatal(err)
+			}
+			repo := &RepoContext{V1: &v1, CircleYaml: []byte(test.circleYml)}
+			version, evidence := nodeDetector{}.Version(repo)
+			if version != test.expected || !strings.HasPrefix(evidence[0].Rule, test.rule) {
+				t.Errorf("%s: expected %s from %q, got %s from %v", test.name, test.expected, test.rule, version, evidence)
+			}
+		})
+	}
+}
+
+func TestPythonVersion(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		files    map[string]string
+		expected string
+		rule     string
+	}{
+		{name: "default", expected: "2.7", rule: "default python version"},
+		{name: ".python-version", files: map[string]string{".python-version": "3.6.5\n"}, expected: "3.6", rule: "pyenv version"},
+		{name: "pyenv virtualenv", files: map[string]string{".python-version": "3.6.5/envs/x\n"}, expected: "3.6", rule: "pyenv version"},
+		{name: "runtime.txt", files: map[string]string{"runtime.txt": "python-3.7.0"}, expected: "3.7", rule: "python runtime"},
+		{
+			name:     ".python-version before runtime.txt",
+			files:    map[string]string{".python-version": "3.5.2", "runtime.txt": "python-3.7.0"},
+			expected: "3.5",
+			rule:     "pyenv version",
+		},
+		{name: "tox", files: map[string]string{"tox.ini": "[tox]\nenvlist = py36, py27\n"}, expected: "3.6", rule: "first envlist environment"},
+	} {
+		inTempDir(t, func() {
+			writeFiles(t, test.files)
+			version, evidence := pythonDetector{}.Version(&RepoContext{V1: &models.CircleYamlV1{}})
+			if version != test.expected || !strings.HasPrefix(evidence[0].Rule, test.rule) {
+				t.Errorf("%s: expected %s from %q, got %s from %v", test.name, test.expected, test.rule, version, evidence)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// built-in service detectors
+func init() {
+	registerServiceDetector(10, postgresDetector{})
+	registerServiceDetector(20, mongoDetector{})
+	registerServiceDetector(25, mentionDetector{
+		service:         REDIS_DB_TYPE,
+		makefilePattern: `redis-cli|redis://localhost|redis://127.0.0.1`,
+		makefileRule:    "runs redis-cli or mentions a local redis:// URL",
+		testFilePattern: "[a-z]*redis",
+	})
+	registerServiceDetector(30, mentionDetector{
+		service:         MYSQL_DB_TYPE,
+		makefilePattern: `mysql -u|mysql://localhost|mysql://127.0.0.1`,
+		makefileRule:    "runs mysql or mentions a local mysql:// URL",
+		testFilePattern: "mysql",
+	})
+	registerServiceDetector(40, mentionDetector{
+		service:         ELASTICSEARCH_DB_TYPE,
+		makefilePattern: `localhost:9200|127.0.0.1:9200`,
+		makefileRule:    "mentions elasticsearch's local port 9200",
+		testFilePattern: "elasticsearch",
+	})
+	registerServiceDetector(50, mentionDetector{
+		service:         RABBITMQ_DB_TYPE,
+		makefilePattern: `amqp://localhost|amqp://127.0.0.1|amqp://guest`,
+		makefileRule:    "mentions a local amqp:// URL",
+		testFilePattern: `rabbitmq|amqp`,
+	})
+	registerServiceDetector(60, mentionDetector{
+		service:         MEMCACHED_DB_TYPE,
+		makefilePattern: `localhost:11211|127.0.0.1:11211`,
+		makefileRule:    "mentions memcached's local port 11211",
+		testFilePattern: `memcached|memcache`,
+	})
+	registerServiceDetector(70, mentionDetector{
+		service:         CASSANDRA_DB_TYPE,
+		makefilePattern: `cqlsh`,
+		makefileRule:    "runs cqlsh",
+		testFilePattern: "cassandra",
+	})
+	registerServiceDetector(80, mentionDetector{
+		service:         DYNAMODB_LOCAL_DB_TYPE,
+		makefilePattern: `dynamodb-local|DynamoDBLocal`,
+		makefileRule:    "mentions dynamodb-local",
+		testFilePattern: `dynamodb-local|DynamoDBLocal`,
+	})
+}
+
+// postgresDetector detects that tests rely on postgresql, based on these criteria:
+// -- the Makefile or a circle.yml command runs psql or has a local postgres:// connection string
+// -- a docker-compose file has a postgres service, or the code imports a postgres driver (lib/pq, pgx, pg, psycopg2)
+// -- a file with `test` in the name has a local postgres:// connection string (less confident)
+// comments, vendored code and generated code are ignored
+type postgresDetector struct{}
+
+func (postgresDetector) Service() string { return POSTGRESQL_DB_TYPE }
+
+func (postgresDetector) Detect(repo *RepoContext) (models.ServiceDetection, bool) {
+	return detectSignals(POSTGRESQL_DB_TYPE, repo, serviceSignals{
+		command:          `\bpsql\b|postgres(ql)?://(localhost|127\.0\.0\.1)`,
+		commandRule:      "runs psql or connects to a local postgres",
+		driverImport:     `"github\.com/lib/pq"|"github\.com/jackc/pgx|require\(\s*['"]pg['"]\s*\)|from\s+['"]pg['"]|^\s*(import|from)\s+psycopg2`,
+		driverPackages:   []string{"pg"},
+		connectionString: `postgres(ql)?://(localhost|127\.0\.0\.1)`,
+	})
+}
+
+// mongoDetector detects that tests rely on mongodb, based on these criteria:
+// -- the Makefile or a circle.yml command uses MONGO_TEST_DB or a local mongodb:// connection string
+// -- a docker-compose file has a mongo service, or the code imports a mongo driver (mgo, mongo-go-driver, mongodb, mongoose, pymongo)
+// -- a file with `test` in the name has a local mongodb:// connection string (less confident)
+// comments, vendored code and generated code are ignored
+type mongoDetector struct{}
+
+func (mongoDetector) Service() string { return MONGO_DB_TYPE }
+
+func (mongoDetector) Detect(repo *RepoContext) (models.ServiceDetection, bool) {
+	return detectSignals(MONGO_DB_TYPE, repo, serviceSignals{
+		command:          `MONGO_TEST_DB|mongodb://(localhost|127\.0\.0\.1)`,
+		commandRule:      "uses MONGO_TEST_DB or connects to a local mongodb",
+		driverImport:     `"gopkg\.in/mgo\.v2"|"github\.com/globalsign/mgo"|"go\.mongodb\.org/mongo-driver|"github\.com/mongodb/mongo-go-driver|require\(\s*['"](mongodb|mongoose)['"]\s*\)|from\s+['"](mongodb|mongoose)['"]|^\s*(import|from)\s+pymongo`,
+		driverPackages:   []string{"mongodb", "mongoose"},
+		connectionString: `mongodb://(localhost|127\.0\.0\.1)`,
+	})
+}
+
+// serviceSignals are patterns that show a repo really uses a service, rather than just mentioning it
+type serviceSignals struct {
+	// command matches a Makefile line or circle.yml command that uses the service
+	command     string
+	commandRule string
+	// driverImport matches a line of code that imports a driver for the service
+	driverImport string
+	// driverPackages are npm packages that are drivers for the service
+	driverPackages []string
+	// connectionString matches a connection string to the service in test files
+	connectionString string
+}
+
+// detectSignals returns a detection of service from the strongest of signals found in the repo
+func detectSignals(service string, repo *RepoContext, signals serviceSignals) (models.ServiceDetection, bool) {
+	commandRegexp := regexp.MustCompile(signals.command)
+	if evidence, ok := matchEvidence("Makefile", withoutComments(repo.Makefile), commandRegexp, signals.commandRule); ok {
+		return models.ServiceDetection{Service: service, Confidence: 0.9, Evidence: []models.Evidence{evidence}}, true
+	}
+	for _, command := range v1Commands(repo.V1) {
+		if commandRegexp.MatchString(command) {
+			evidence := circleYamlCommandEvidence(repo.CircleYaml, command, fmt.Sprintf("command `%s` %s", command, signals.commandRule))
+			return models.ServiceDetection{Service: service, Confidence: 0.9, Evidence: []models.Evidence{evidence}}, true
+		}
+	}
+
+	evidence := dockerComposeServiceEvidence(service)
+	evidence = append(evidence, packageJSONDependencyEvidence(service, signals.driverPackages)...)
+	evidence = append(evidence, searchSourceFiles(regexp.MustCompile(signals.driverImport), fmt.Sprintf("imports a %s driver", service), false)...)
+	if len(evidence) > 0 {
+		return models.ServiceDetection{Service: service, Confidence: 0.8, Evidence: evidence}, true
+	}
+
+	evidence = searchSourceFiles(regexp.MustCompile(signals.connectionString), fmt.Sprintf("test file connects to a local %s", service), true)
+	if len(evidence) == 0 {
+		return models.ServiceDetection{}, false
+	}
+	return models.ServiceDetection{Service: service, Confidence: 0.6, Evidence: evidence}, true
+}
+
+// dockerComposeServiceEvidence returns evidence for each docker-compose file with a service using one of service's images
+func dockerComposeServiceEvidence(service string) []models.Evidence {
+	imageNames := serviceCatalog[service].Hints.ImageNames
+	if len(imageNames) == 0 {
+		return nil
+	}
+	imageRegexp := regexp.MustCompile(`image:\s*["']?(?:[a-z0-9.-]+/)*(?:` + strings.Join(imageNames, "|") + `)(?:[:@"'\s]|$)`)
+	evidence := []models.Evidence{}
+	for _, pattern := range dockerComposeFiles {
+		matches, _ := filepath.Glob(pattern)
+		for _, file := range matches {
+			contents, err := ioutil.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			if found, ok := matchEvidence(file, withoutComments(contents), imageRegexp, fmt.Sprintf("docker-compose service uses a %s image", service)); ok {
+				evidence = append(evidence, found)
+			}
+		}
+	}
+	return evidence
+}
+
+// packageJSONDependencyEvidence returns evidence for each of packages that package.json depends on
+func packageJSONDependencyEvidence(service string, packages []string) []models.Evidence {
+	contents, err := ioutil.ReadFile("package.json")
+	if err != nil || len(packages) == 0 {
+		return nil
+	}
+	var pkg struct {
+		Dependencies    map[string]string `json:"dependencies"`
+		DevDependencies map[string]string `json:"devDependencies"`
+	}
+	if err := json.Unmarshal(contents, &pkg); err != nil {
+		return nil
+	}
+	evidence := []models.Evidence{}
+	for _, name := range packages {
+		_, dependency := pkg.Dependencies[name]
+		_, devDependency := pkg.DevDependencies[name]
+		if dependency || devDependency {
+			evidence = append(evidence, models.Evidence{
+				File: "package.json",
+				Line: lineContaining(contents, fmt.Sprintf("%q", name)),
+				Rule: fmt.Sprintf("depends on %s driver %s", service, name),
+			})
+		}
+	}
+	return evidence
+}
+
+// ignoredDirRegexp matches directories of code the repo doesn't write by hand: vendored, installed and generated code
+var ignoredDirRegexp = regexp.MustCompile(`^(vendor|node_modules|Godeps|bower_components|\.git|gen-.*)$`)
+
+// generatedFileRegexp matches the markers of generated files, e.g. "// Code generated by wag. DO NOT EDIT."
+var generatedFileRegexp = regexp.MustCompile(`(?m)^\s*(//|#) Code generated .* DO NOT EDIT\.|@generated`)
+
+// sourceFileRegexp matches the names of files searched for driver imports and connection strings
+var sourceFileRegexp = regexp.MustCompile(`\.(go|js|jsx|ts|coffee|py|rb|java|scala|json|ya?ml|env|cfg|ini|conf)$`)
+
+// searchSourceFiles returns evidence for each line (up to maxGrepEvidence) of source files that matches re,
+// only searching files with `test` in the name if testOnly, and ignoring comments, vendored code and generated code
+func searchSourceFiles(re *regexp.Regexp, rule string, testOnly bool) []models.Evidence {
+	evidence := []models.Evidence{}
+	for _, line := range searchSourceFileLines(re, rule, testOnly) {
+		evidence = append(evidence, line.Evidence)
+	}
+	return evidence
+}
+
+// sourceFileLine is a line of a source file that matched a search
+type sourceFileLine struct {
+	Evidence models.Evidence
+	Text     string
+}
+
+// searchSourceFileLines returns each line (up to maxGrepEvidence) that searchSourceFiles finds, with evidence for rule
+func searchSourceFileLines(re *regexp.Regexp, rule string, testOnly bool) []sourceFileLine {
+	lines := []sourceFileLine{}
+	filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil || len(lines) == maxGrepEvidence {
+			return nil
+		}
+		if info.IsDir() {
+			if path != "." && ignoredDirRegexp.MatchString(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !sourceFileRegexp.MatchString(info.Name()) || (testOnly && !strings.Contains(info.Name(), "test")) {
+			return nil
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil || generatedFileRegexp.Match(contents) {
+			return nil
+		}
+		for i, line := range strings.Split(string(withoutComments(contents)), "\n") {
+			if re.MatchString(line) {
+				lines = append(lines, sourceFileLine{Evidence: models.Evidence{File: path, Line: i + 1, Rule: rule}, Text: line})
+				if len(lines) == maxGrepEvidence {
+					break
+				}
+			}
+		}
+		return nil
+	})
+	return lines
+}
+
+// commentLineRegexp matches lines that are only a comment, in the languages (and Makefiles) detectors search
+var commentLineRegexp = regexp.MustCompile(`^\s*(//|#|/\*|\*|--)`)
+
+// withoutComments returns contents with comment lines blanked out, so line numbers stay the same
+func withoutComments(contents []byte) []byte {
+	lines := strings.Split(string(contents), "\n")
+	for i, line := range lines {
+		if commentLineRegexp.MatchString(line) {
+			lines[i] = ""
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// mentionDetector detects that tests rely on a service, based on these criteria:
+// -- the Makefile matches makefilePattern
+// -- a file with `test` in the name contains a word matching testFilePattern, a regexp (less confident)
+type mentionDetector struct {
+	service         string
+	makefilePattern string
+	makefileRule    string
+	testFilePattern string
+}
+
+func (d mentionDetector) Service() string { return d.service }
+
+func (d mentionDetector) Detect(repo *RepoContext) (models.ServiceDetection, bool) {
+	if evidence, ok := matchEvidence("Makefile", withoutComments(repo.Makefile), regexp.MustCompile(d.makefilePattern), d.makefileRule); ok {
+		return models.ServiceDetection{Service: d.service, Confidence: 0.9, Evidence: []models.Evidence{evidence}}, true
+	}
+	testFileRegexp := regexp.MustCompile(`\b(?:` + d.testFilePattern + `)\b`)
+	evidence := searchSourceFiles(testFileRegexp, fmt.Sprintf("test file mentions %s", d.service), true)
+	if len(evidence) == 0 {
+		return models.ServiceDetection{}, false
+	}
+	return models.ServiceDetection{Service: d.service, Confidence: 0.6, Evidence: evidence}, true
+}
+
+// maxGrepEvidence is the most matches kept as evidence for a detection
+const maxGrepEvidence = 5
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+func TestMentionDetectorMakefile(t *testing.T) {
+	detector := mentionDetector{
+		service:         REDIS_DB_TYPE,
+		makefilePattern: `redis-cli|redis://localhost|redis://127.0.0.1`,
+		makefileRule:    "runs redis-cli or mentions a local redis:// URL",
+		testFilePattern: "[a-z]*redis",
+	}
+	for _, test := range []struct {
+		name     string
+		makefile string
+		line     int
+	}{
+		{name: "command", makefile: "test:\n\tredis-cli ping\n\tgo test ./...\n", line: 2},
+		{name: "commented command", makefile: "test:\n\t# redis-cli ping\n\tgo test ./...\n"},
+		{name: "comment line", makefile: "# needs redis-cli installed\ntest:\n\tgo test ./...\n"},
+		{name: "command after a comment", makefile: "# redis-cli flushes the database\ntest:\n\tredis-cli flushall\n", line: 3},
+	} {
+		inTempDir(t, func() {
+			detection, ok := detector.Detect(&RepoContext{V1: &models.CircleYamlV1{}, Makefile: []byte(test.makefile)})
+			if test.line == 0 {
+				if ok {
+					t.Errorf("%s: expected no detection, got %v", test.name, detection.Evidence)
+				}
+			} else if !ok || detection.Evidence[0].Line != test.line {
+				t.Errorf("%s: expected detection at line %d, got %v (ok %v)", test.name, test.line, detection.Evidence, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+)
+
+// exit codes, also documented in the README
+// 2 matches the flag package's exit code for bad flags
+const EXIT_SUCCESS = 0
+const EXIT_INTERNAL_ERROR = 1
+const EXIT_USAGE_ERROR = 2
+const EXIT_SUCCESS_WITH_WARNINGS = 3
+const EXIT_UNSUPPORTED_INPUT = 4
+
+// unsupportedInputError is an error caused by a circle.yml or repo the migration can't handle,
+// as opposed to a bug or an I/O failure
+type unsupportedInputError struct {
+	error
+}
+
+// unsupportedInput returns an unsupportedInputError with a formatted message
+func unsupportedInput(format string, args ...interface{}) error {
+	return unsupportedInputError{fmt.Errorf(format, args...)}
+}
+
+// exitCode returns the exit code for a migration that ended with err (nil if it succeeded):
+// -- EXIT_UNSUPPORTED_INPUT if err is an unsupportedInputError
+// -- EXIT_INTERNAL_ERROR for any other error
+// -- EXIT_SUCCESS_WITH_WARNINGS if any warning or error was recorded while converting
+// -- EXIT_SUCCESS otherwise (info-level warnings don't count)
+func exitCode(err error) int {
+	if err != nil {
+		if _, ok := err.(unsupportedInputError); ok {
+			return EXIT_UNSUPPORTED_INPUT
+		}
+		return EXIT_INTERNAL_ERROR
+	}
+	for _, warning := range warnings {
+		if warning.Severity != INFO_SEVERITY {
+			return EXIT_SUCCESS_WITH_WARNINGS
+		}
+	}
+	return EXIT_SUCCESS
+}
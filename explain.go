@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// kinds of decisions recorded for --explain
+const APP_TYPE_DECISION = "app type"
+const VERSION_DECISION = "version"
+const SERVICE_VERSION_DECISION = "service version"
+const IMAGE_DECISION = "image"
+const WORKING_DIRECTORY_DECISION = "working directory"
+const SERVICE_DECISION = "service"
+const STEP_DECISION = "step"
+const REQUIREMENT_DECISION = "requirement"
+const ENVIRONMENT_DECISION = "environment"
+
+// decisions are the choices made while converting, in the order they were made
+var decisions = []models.Decision{}
+
+// explain records a decision and the evidence it was based on
+func explain(kind, value string, evidence ...models.Evidence) {
+	decisions = append(decisions, models.Decision{
+		Kind:     kind,
+		Value:    value,
+		Evidence: evidence,
+	})
+}
+
+// printExplanation writes every recorded decision, one per line, each followed by its evidence, e.g.
+//
+//	app type: node
+//	  package.json: file exists
+//	version: 10
+//	  .nvmrc:1: nvm version v10.4.0
+func printExplanation(w io.Writer) {
+	for _, decision := range decisions {
+		fmt.Fprintf(w, "%s: %s\n", decision.Kind, decision.Value)
+		for _, evidence := range decision.Evidence {
+			fmt.Fprintf(w, "  %s\n", evidence)
+		}
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Clever/circle-v2-migrate/models"
 	// use Clever fork of go-yaml/yaml because go-yaml/yaml limits lines to 80 characters
@@ -21,73 +24,334 @@ const GOLANG_APP_TYPE = "go"
 const NODE_APP_TYPE = "node"
 const WAG_APP_TYPE = "wag"
 const PYTHON_APP_TYPE = "python"
+const RUBY_APP_TYPE = "ruby"
+const JAVA_APP_TYPE = "java"
+const PHP_APP_TYPE = "php"
+const HASKELL_APP_TYPE = "haskell"
 const UNKNOWN_APP_TYPE = "unknown"
 
 const MONGO_DB_TYPE = "mongo"
 const POSTGRESQL_DB_TYPE = "postgresql"
 const REDIS_DB_TYPE = "redis"
+const MYSQL_DB_TYPE = "mysql"
+const ELASTICSEARCH_DB_TYPE = "elasticsearch"
+const RABBITMQ_DB_TYPE = "rabbitmq"
+const MEMCACHED_DB_TYPE = "memcached"
+const CASSANDRA_DB_TYPE = "cassandra"
+const DYNAMODB_LOCAL_DB_TYPE = "dynamodb-local"
+
+// serviceEntry is a service container the build job can attach, and how to tell when it's ready
+type serviceEntry struct {
+	// Image is the image used when the repo doesn't say which version it uses
+	Image models.DockerImage
+	// Versions are the images for each version we have one for, keyed by major or major.minor version
+	Versions map[string]models.DockerImage
+	// Hints are how the repo says which version it uses
+	Hints serviceVersionHints
+	// Port is the port the service listens on, which the build waits for before running commands
+	Port int
+	// Probe is a command, run in the primary container, that succeeds once the service is ready. Without one, or if
+	// the primary image doesn't have the probe's command, the build waits until Port accepts connections.
+	Probe string
+	// Environment configures the image, e.g. to use less memory than its defaults
+	Environment map[string]string
+	// Credentials are how a database image is told which user and database to create, if it is a database
+	Credentials *databaseCredentials
+}
 
-var dbImageMap = map[string]models.DockerImage{
+var serviceCatalog = map[string]serviceEntry{
 	// @TODO: SHAs, also decide most appropriate images to use
-	POSTGRESQL_DB_TYPE: models.DockerImage{
-		Image: "circleci/postgres:9.4-alpine-ram",
+	POSTGRESQL_DB_TYPE: {
+		Image: models.DockerImage{Image: "circleci/postgres:9.4-alpine-ram"},
+		Versions: map[string]models.DockerImage{
+			"9.4": {Image: "circleci/postgres:9.4-alpine-ram"},
+			"9.5": {Image: "circleci/postgres:9.5-alpine-ram"},
+			"9.6": {Image: "circleci/postgres:9.6-alpine-ram"},
+			"10":  {Image: "circleci/postgres:10-alpine-ram"},
+			"11":  {Image: "circleci/postgres:11-alpine-ram"},
+		},
+		Hints: serviceVersionHints{
+			ImageNames:     []string{"postgres"},
+			ServiceNames:   []string{"postgresql", "postgres"},
+			PackagePattern: `postgresql-([0-9][0-9.]*)`,
+		},
+		Port:  5432,
+		Probe: `pg_isready -h localhost -p 5432`,
+		Credentials: &databaseCredentials{
+			Schemes:     []string{"postgres", "postgresql"},
+			UserEnv:     "POSTGRES_USER",
+			PasswordEnv: "POSTGRES_PASSWORD",
+			DatabaseEnv: "POSTGRES_DB",
+		},
+	},
+	MYSQL_DB_TYPE: {
+		Image: models.DockerImage{Image: "circleci/mysql:5.6-ram"},
+		Versions: map[string]models.DockerImage{
+			"5.6": {Image: "circleci/mysql:5.6-ram"},
+			"5.7": {Image: "circleci/mysql:5.7-ram"},
+			"8.0": {Image: "circleci/mysql:8.0-ram"},
+		},
+		Hints: serviceVersionHints{
+			ImageNames:     []string{"mysql"},
+			ServiceNames:   []string{"mysql"},
+			PackagePattern: `mysql-server-([0-9][0-9.]*)`,
+		},
+		Port:  3306,
+		Probe: `mysqladmin ping -h 127.0.0.1 -P 3306 --silent`,
+		Credentials: &databaseCredentials{
+			Schemes:     []string{"mysql"},
+			UserEnv:     "MYSQL_USER",
+			PasswordEnv: "MYSQL_PASSWORD",
+			DatabaseEnv: "MYSQL_DATABASE",
+			// the image always creates root; MYSQL_USER is only for other users
+			RootUser:             "root",
+			RootPasswordEnv:      "MYSQL_ROOT_PASSWORD",
+			EmptyRootPasswordEnv: "MYSQL_ALLOW_EMPTY_PASSWORD",
+			UserNeedsPassword:    true,
+		},
+	},
+	MONGO_DB_TYPE: {
+		Image: models.DockerImage{Image: "circleci/mongo:3.2.20-jessie-ram"},
+		Versions: map[string]models.DockerImage{
+			"3.2": {Image: "circleci/mongo:3.2.20-jessie-ram"},
+			"3.4": {Image: "circleci/mongo:3.4-jessie-ram"},
+			"3.6": {Image: "circleci/mongo:3.6-jessie-ram"},
+			"4.0": {Image: "circleci/mongo:4.0-ram"},
+		},
+		Hints: serviceVersionHints{
+			ImageNames:     []string{"mongo"},
+			ServiceNames:   []string{"mongodb", "mongod"},
+			PackagePattern: `mongodb-org(?:-server)?=([0-9][0-9.]*)`,
+			// drivers only work with servers from their release or older, so these are the newest server each supports
+			Drivers: []serviceDriver{
+				{File: "package.json", Name: "mongodb", Versions: map[string]string{"2": "3.4", "3": "4.0"}},
+				{File: "package.json", Name: "mongoose", Versions: map[string]string{"4": "3.4", "5": "4.0"}},
+				{File: "Gopkg.lock", Name: "github.com/mongodb/mongo-go-driver", Versions: map[string]string{"": "4.0"}},
+				{File: "Gopkg.lock", Name: "github.com/globalsign/mgo", Versions: map[string]string{"": "3.6"}},
+				{File: "Gopkg.lock", Name: "gopkg.in/mgo.v2", Versions: map[string]string{"": "3.4"}},
+			},
+		},
+		Port: 27017,
+	},
+	REDIS_DB_TYPE: {
+		Image: models.DockerImage{Image: "redis@sha256:858b1677143e9f8455821881115e276f6177221de1c663d0abef9b2fda02d065"},
+		Hints: serviceVersionHints{
+			ImageNames:   []string{"redis"},
+			ServiceNames: []string{"redis"},
+		},
+		Port: 6379,
+	},
+	ELASTICSEARCH_DB_TYPE: {
+		Image: models.DockerImage{Image: "docker.elastic.co/elasticsearch/elasticsearch:6.4.2"},
+		Versions: map[string]models.DockerImage{
+			"5.6": {Image: "docker.elastic.co/elasticsearch/elasticsearch:5.6.12"},
+			"6.4": {Image: "docker.elastic.co/elasticsearch/elasticsearch:6.4.2"},
+		},
+		Hints: serviceVersionHints{
+			ImageNames:     []string{"elasticsearch"},
+			ServiceNames:   []string{"elasticsearch"},
+			PackagePattern: `elasticsearch=([0-9][0-9.]*)`,
+		},
+		Port:  9200,
+		Probe: `curl -fs 'http://localhost:9200/_cluster/health?wait_for_status=yellow&timeout=1s'`,
+		// a single node without x-pack security, like the unauthenticated elasticsearch of CircleCI 1.0
+		Environment: map[string]string{
+			"discovery.type":         "single-node",
+			"xpack.security.enabled": "false",
+			"ES_JAVA_OPTS":           "-Xms512m -Xmx512m",
+		},
 	},
-	MONGO_DB_TYPE: models.DockerImage{
-		// @TODO: 3.4?
-		Image: "circleci/mongo:3.2.20-jessie-ram",
+	RABBITMQ_DB_TYPE: {
+		Image: models.DockerImage{Image: "rabbitmq:3.7-alpine"},
+		Versions: map[string]models.DockerImage{
+			"3.6": {Image: "rabbitmq:3.6-alpine"},
+			"3.7": {Image: "rabbitmq:3.7-alpine"},
+		},
+		Hints: serviceVersionHints{
+			ImageNames:     []string{"rabbitmq"},
+			ServiceNames:   []string{"rabbitmq-server", "rabbitmq"},
+			PackagePattern: `rabbitmq-server=([0-9][0-9.]*)`,
+		},
+		Port: 5672,
+		Environment: map[string]string{
+			"RABBITMQ_DEFAULT_USER": "guest",
+			"RABBITMQ_DEFAULT_PASS": "guest",
+		},
 	},
-	REDIS_DB_TYPE: models.DockerImage{
-		Image: "redis@sha256:858b1677143e9f8455821881115e276f6177221de1c663d0abef9b2fda02d065",
+	MEMCACHED_DB_TYPE: {
+		Image: models.DockerImage{Image: "memcached:1.5-alpine"},
+		Versions: map[string]models.DockerImage{
+			"1.4": {Image: "memcached:1.4-alpine"},
+			"1.5": {Image: "memcached:1.5-alpine"},
+		},
+		Hints: serviceVersionHints{
+			ImageNames:   []string{"memcached"},
+			ServiceNames: []string{"memcached"},
+		},
+		Port: 11211,
+	},
+	CASSANDRA_DB_TYPE: {
+		Image: models.DockerImage{Image: "cassandra:3.11"},
+		Versions: map[string]models.DockerImage{
+			"2.2":  {Image: "cassandra:2.2"},
+			"3.0":  {Image: "cassandra:3.0"},
+			"3.11": {Image: "cassandra:3.11"},
+		},
+		Hints: serviceVersionHints{
+			ImageNames:     []string{"cassandra"},
+			ServiceNames:   []string{"cassandra"},
+			PackagePattern: `cassandra=([0-9][0-9.]*)`,
+		},
+		Port:  9042,
+		Probe: `cqlsh localhost 9042 -e 'describe keyspaces'`,
+		// the default heap is sized for the host, which is more than a build container has
+		Environment: map[string]string{
+			"MAX_HEAP_SIZE": "512M",
+			"HEAP_NEWSIZE":  "100M",
+		},
+	},
+	DYNAMODB_LOCAL_DB_TYPE: {
+		// runs in memory by default
+		Image: models.DockerImage{Image: "amazon/dynamodb-local"},
+		Hints: serviceVersionHints{
+			ServiceNames: []string{"dynamodb-local", "dynamodb"},
+		},
+		Port: 8000,
 	},
 }
 
 var (
 	makefile      = []byte{}
 	circleCI1File = []byte{}
+	// serviceWaitTimeout is how long the build waits for service containers to be ready
+	serviceWaitTimeout = 60 * time.Second
+	// attachedServices are the service containers attached to the build job, for the report
+	attachedServices = []models.Service{}
+	// allowedServices are always attached, and deniedServices never are, whatever is detected or listed in circle.yml
+	allowedServices = []string{}
+	deniedServices  = []string{}
 )
 
 // https://circleci.com/docs/2.0/migrating-from-1-2/
 
 // @TODO: add info about target repo (e.g., name) to log lines (kayvee?)
-// @TODO: breaks for mongo-to-s3, which uses golang-move-repo ci-scripts script :(
+// @TODO: breaks for mongo-to-s3, which uses golang-move-repo ci-scripts script :( -- fix with an entry in an --overrides manifest
 func main() {
+	explainFlag := flag.Bool("explain", false, "after migrating, print each detection decision and the evidence for it")
+	reportPath := flag.String("report", "", "write a JSON migration report to this path (e.g. .circleci/migration-report.json), or to stdout if -")
+	flag.DurationVar(&serviceWaitTimeout, "service-wait-timeout", serviceWaitTimeout, "how long the migrated build waits for service containers (databases, redis, ...) to be ready")
+	flag.StringVar(&overridesManifest, "overrides", "", "a manifest of overrides for many repos, keyed by repo name, in the same format as "+OVERRIDES_FILE)
+	flag.StringVar(&repoFlag, "repo", "", "the repo's org and name, e.g. Clever/catapult (default: from the origin remote, or the current directory)")
+	flag.StringVar(&importPathFlag, "import-path", "", "the go import path of the repo (default: from go.mod, an import comment, or the repo's org and name)")
+	strictFlag := flag.Bool("strict", false, "fail if circle.yml has keys that aren't CircleCI 1.0 keys (e.g. misspellings), instead of ignoring them")
+	allowServicesFlag := flag.String("allow-services", "", "comma-separated services (e.g. postgresql,redis) to attach even if they aren't detected")
+	denyServicesFlag := flag.String("deny-services", "", "comma-separated services (e.g. mongo) never to attach, even if they are detected or listed in circle.yml")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [explain]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  explain\tprint each detection decision and the evidence for it, without migrating\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	var flagErr error
+	if allowedServices, flagErr = parseServiceList(*allowServicesFlag); flagErr == nil {
+		deniedServices, flagErr = parseServiceList(*denyServicesFlag)
+	}
+	if flagErr == nil {
+		flagErr = parseRepoFlag(repoFlag)
+	}
+	if flagErr != nil {
+		fmt.Fprintln(os.Stderr, flagErr)
+		flag.Usage()
+		os.Exit(EXIT_USAGE_ERROR)
+	}
+	explainOnly := false
+	switch {
+	case flag.NArg() == 0:
+	case flag.NArg() == 1 && flag.Arg(0) == "explain":
+		explainOnly = true
+	default:
+		flag.Usage()
+		os.Exit(EXIT_USAGE_ERROR)
+	}
+
+	if *reportPath == "-" {
+		// keep stdout for the report alone
+		os.Stdout = os.Stderr
+	}
+
+	var v2 models.CircleYamlV2
+	// location is where the repo lives, determined once so its warnings are reported once
+	var location repoLocation
+	// finish writes the migration report (if requested) and exits with the exit code for err,
+	// which is nil if the migration succeeded
+	finish := func(err error) {
+		if err != nil {
+			log.Print(err)
+			warn(ERROR_SEVERITY, MIGRATION_FAILED_WARNING, err.Error())
+		}
+		code := exitCode(err)
+		if *reportPath != "" {
+			if reportErr := writeReport(buildReport(location.Repo, v2, code), *reportPath); reportErr != nil {
+				log.Print(reportErr)
+				code = EXIT_INTERNAL_ERROR
+			}
+		}
+		os.Exit(code)
+	}
+
 	fmt.Printf("circle-v2-migrate v%s\n", SCRIPT_VERSION)
 	v1, err := readCircleYaml()
 	if err != nil {
-		log.Fatal(err)
+		finish(err)
+	}
+	if location, err = determineRepo(); err != nil {
+		finish(err)
+	}
+	if err := checkUnknownKeys(*strictFlag); err != nil {
+		finish(err)
 	}
 
-	v2, err := convertToV2(v1)
+	v2, err = convertToV2(v1, location)
 	if err != nil {
-		log.Fatal(err)
+		finish(err)
 	}
 
 	// fmt.Println("---------- circle YAML Preview ---------")
 	marshalled, err := yaml.Marshal(v2)
 	if err != nil {
-		fmt.Printf("Failed to Marshal v2 yml:\n %s", err)
+		finish(fmt.Errorf("Failed to Marshal v2 yml:\n %s", err))
 	} else {
 		// fmt.Println(string(marshalled))
 	}
 
 	// fmt.Println("----------------------------------------")
 
+	if explainOnly {
+		printExplanation(os.Stdout)
+		finish(nil)
+	}
+
 	// after translation, write marshalled YAML to .circleci/config.yml
 	if _, err := os.Stat("./.circleci"); err != nil {
 		os.Mkdir("./.circleci", os.ModePerm)
 	}
 	outFile, err := os.Create("./.circleci/config.yml")
 	if err != nil {
-		log.Fatal(err)
+		finish(err)
 	}
 	fmt.Println("writing circleci 2.0 config to .circleci/config.yml")
 	_, err = outFile.Write(marshalled)
 	if err != nil {
-		log.Fatal(err)
+		finish(err)
 	}
 	// after translation, remove or rename circle.yml
 	fmt.Println("renaming circle.yml -> circle.yml.bak")
 	os.Rename("./circle.yml", "./circle.yml.bak")
+
+	if *explainFlag {
+		printExplanation(os.Stdout)
+	}
+	finish(nil)
 }
 
 // readCircleYaml reads and parses the repo's circle.yml (V1) file
@@ -96,7 +360,7 @@ func readCircleYaml() (models.CircleYamlV1, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		path = "./circle.yml.bak"
 		if _, err := os.Stat(path); os.IsNotExist(err) {
-			return models.CircleYamlV1{}, fmt.Errorf("circle.yml not found at circle.yml or circle.yml.bak")
+			return models.CircleYamlV1{}, unsupportedInput("circle.yml not found at circle.yml or circle.yml.bak")
 		}
 	}
 
@@ -108,7 +372,7 @@ func readCircleYaml() (models.CircleYamlV1, error) {
 
 	var out models.CircleYamlV1
 	if err := yaml.Unmarshal(contents, &out); err != nil {
-		return models.CircleYamlV1{}, err
+		return models.CircleYamlV1{}, circleYamlParseError(err)
 	}
 	return out, nil
 }
@@ -116,10 +380,15 @@ func readCircleYaml() (models.CircleYamlV1, error) {
 // convertToV2 uses the CircleCI 1.0 formatted YAML
 // and other cues in the repo (Makefile, presence of swagger.yml, etc)
 // to create CircleCI 2.0 formatted YAML
-func convertToV2(v1 models.CircleYamlV1) (models.CircleYamlV2, error) {
+func convertToV2(v1 models.CircleYamlV1, location repoLocation) (models.CircleYamlV2, error) {
 	v2 := models.CircleYamlV2{
 		Version: 2,
 	}
+	// requirements are the helper steps (e.g. awscli) that are added at the end, if anything needs them
+	requirements := requirements{}
+
+	reportDroppedKeys(&v1)
+	reportModifiers(&v1)
 
 	makefileBytes, err := ioutil.ReadFile("Makefile")
 	if err == nil {
@@ -128,21 +397,42 @@ func convertToV2(v1 models.CircleYamlV1) (models.CircleYamlV2, error) {
 		// if no makefile, continue with default
 		fmt.Println("no Makefile")
 	}
-	// Determine base image to use based on app type (go/wag/node/...) and language version
-	imageConstraints := determineImageConstraints()
+	if err := readOverrides(location); err != nil {
+		return v2, err
+	}
+	// Determine base image to use based on app type (go/wag/node/...) and language version,
+	// and any services tests need, then apply the repo's overrides on top
+	imageConstraints := determineImageConstraints(&v1)
+	applyImageConstraintOverrides(&v1, &imageConstraints)
 	appType := imageConstraints.AppType
-	primaryImage := getImage(imageConstraints)
+	explain(APP_TYPE_DECISION, appType, imageConstraints.AppTypeEvidence...)
+	if imageConstraints.Version != "" {
+		explain(VERSION_DECISION, imageConstraints.Version, imageConstraints.VersionEvidence...)
+	}
+	primaryImage := overrideImage(PRIMARY_IMAGE_OVERRIDE, func() models.DockerImage { return getImage(imageConstraints) })
 	v2.Jobs.Build.Docker = []models.DockerImage{
 		primaryImage,
 	}
-	// Determine and add additional mongo/postgres image(s) needed
-	dbImages := getDatabaseImages(imageConstraints)
+	// Determine and add additional service image(s) needed, once each, whether they were detected or listed in circle.yml
+	for _, item := range v1.Machine.Services {
+		if service, ok := machineService(item); ok {
+			addService(&imageConstraints, service, MACHINE_SERVICES_SOURCE, machineServiceEvidence(item))
+		}
+	}
+	applyServiceOverrides(&imageConstraints)
+	applyServiceLists(&imageConstraints)
+	for _, dbType := range orderedDatabaseTypes(imageConstraints.DatabaseTypes) {
+		explain(SERVICE_DECISION, dbType, imageConstraints.DatabaseEvidence[dbType]...)
+	}
+	dbImages, services := getDatabaseImages(imageConstraints)
 	v2.Jobs.Build.Docker = append(v2.Jobs.Build.Docker, dbImages...)
 
 	// Determine working directory
-	workingDir, err := determineWorkingDirectory(appType)
-	if err != nil {
-		log.Fatal(err)
+	workingDir := overrides.WorkingDirectory
+	if workingDir != "" {
+		explain(WORKING_DIRECTORY_DECISION, workingDir, overrideEvidence("working_directory"))
+	} else {
+		workingDir = determineWorkingDirectory(appType, location)
 	}
 	v2.Jobs.Build.WorkingDirectory = workingDir
 
@@ -152,67 +442,82 @@ func convertToV2(v1 models.CircleYamlV1) (models.CircleYamlV2, error) {
 		"CIRCLE_TEST_REPORTS": "/tmp/circleci-test-results",
 	}
 
-	// Clone ci-scripts
-	addCloneCIScriptsStep(&v2)
-
 	// Checkout repo
 	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, "checkout")
 
 	// Determine main setup
 	for _, item := range v1.Machine.Services {
 		if item == "docker" {
-			v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, "setup_remote_docker")
-		} else if item == "redis" {
-			v2.Jobs.Build.Docker = append(v2.Jobs.Build.Docker, models.DockerImage{
-				Image: "redis@sha256:858b1677143e9f8455821881115e276f6177221de1c663d0abef9b2fda02d065",
-			})
-		} else {
-			fmt.Printf("!WARNING: ingoring v1.Machine.Services item %s\n\n", item)
+			addSetupRemoteDockerStep(&v2)
+			explain(STEP_DECISION, "setup_remote_docker", machineServiceEvidence(item))
+		} else if _, ok := machineService(item); !ok {
+			warn(WARNING_SEVERITY, UNKNOWN_SERVICE_WARNING, fmt.Sprintf("ignoring v1.Machine.Services item %s", item), machineServiceEvidence(item))
 		}
 	}
 
 	// Create directories that were automatically created in CircleCI 1.0
 	addCreateCIArtifactDirsStep(&v2)
+	explain(STEP_DECISION, "Set up CircleCI artifacts directories", models.Evidence{Rule: "CircleCI 1.0 created $CIRCLE_ARTIFACTS and $CIRCLE_TEST_REPORTS"})
 
 	// Set up .npmrc if needed (for using private npm packages)
 	if _, err := os.Stat("./.npmrc_docker"); err == nil {
 		addSetupNPMRCStep(&v2)
+		explain(STEP_DECISION, "Set up .npmrc", fileEvidence(".npmrc_docker", "file exists"))
 	}
 
 	if appType == NODE_APP_TYPE {
 		// run npm install for all node apps
 		addNPMInstallStep(&v2)
+		explain(STEP_DECISION, "npm install", models.Evidence{Rule: "app type is node"})
 		// @TODO: additional steps for old node versions
 		v, err := strconv.Atoi(imageConstraints.Version)
 		if err != nil {
-			fmt.Printf("invalid node version %s\n", imageConstraints.Version)
+			warn(WARNING_SEVERITY, MANUAL_FOLLOW_UP_WARNING, fmt.Sprintf("invalid node version %s", imageConstraints.Version), imageConstraints.VersionEvidence...)
 		} else if v < 6 {
-			fmt.Printf("OH NO IT'S NODE %s\n", imageConstraints.Version)
+			warn(WARNING_SEVERITY, MANUAL_FOLLOW_UP_WARNING,
+				fmt.Sprintf("node %s is older than the oldest node image (6) -- check that the build works on node 6", imageConstraints.Version),
+				imageConstraints.VersionEvidence...)
 		}
 	}
 
+	// CircleCI 1.0 inferred dependency install steps for some app types unless dependencies were overridden
+	if installer, ok := appDetector(appType).(DependencyInstaller); ok && len(v1.Dependencies.Override) == 0 {
+		installer.AddInstallSteps(&v2, imageConstraints.Version)
+		explain(STEP_DECISION, appType+" dependency install",
+			models.Evidence{Rule: fmt.Sprintf("CircleCI 1.0 inferred dependency install steps for %s apps", appType)},
+			models.Evidence{File: "circle.yml", Rule: "no dependencies.override"})
+	}
+
 	_, usesPostgresql := imageConstraints.DatabaseTypes[POSTGRESQL_DB_TYPE]
 	if usesPostgresql {
-		addInstallPSQLStep(&v2)
-		addWaitForPostgresStep(&v2)
+		requirements.add(PSQL_REQUIREMENT, len(v2.Jobs.Build.Steps), models.Evidence{Rule: "tests use postgresql"})
+	}
+	if len(services) > 0 {
+		addWaitForServicesStep(&v2, services)
+		explain(STEP_DECISION, "Wait for services to be ready", models.Evidence{Rule: "service containers: " + strings.Join(services, ", ")})
 	}
 	// translate DEPENDENCIES steps
 	// @TODO - currenlty can lead to redundancy
 	translateDependenciesSteps(&v1, &v2)
+	if phaseIsSet(v1.Dependencies) {
+		warn(INFO_SEVERITY, MANUAL_FOLLOW_UP_WARNING, "circle.yml has a dependencies section -- check for redundant steps",
+			circleYamlKeyEvidence("dependencies"))
+	}
 
 	// translate COMPILE & TEST steps
 	translateCompileSteps(&v1, &v2)
 	translateTestSteps(&v1, &v2)
+	addOverrideSteps(&v2)
 
-	// Install awscli for ECR interactions (used in docker publish deployment steps)
-	addInstallAWSCLIStep(&v2)
+	// translate DEPLOYMENT steps, deduplicating those on master and non-master branches
+	translateDeploySteps(&v1, &v2)
 
-	// translate and deduplicate DEPLOYMENT steps on master and non-master branches
-	err = translateDeploySteps(&v1, &v2)
-	if err != nil {
-		fmt.Printf("error translating deploy steps: %s\n", err)
-		return models.CircleYamlV2{}, err
-	}
+	// Add the helper steps (ci-scripts, awscli, node, ...) that detectors or commands need
+	recognizeCIScripts(&v2, requirements)
+	addCommandRequirements(&v2, requirements)
+	addRequiredHelpers(&v2, requirements)
+
+	validateRunCommands(&v2)
 
 	return v2, nil
 }
@@ -253,71 +558,6 @@ func translateTestSteps(v1 *models.CircleYamlV1, v2 *models.CircleYamlV2) {
 	}
 }
 
-func translateDeploySteps(v1 *models.CircleYamlV1, v2 *models.CircleYamlV2) error {
-	for key := range v1.Deployment {
-		if key != "master" && key != "non-master" && key != "all" {
-			return fmt.Errorf("unexpected key in `deployment` map = %s", key)
-		}
-	}
-
-	nonMaster, nonMasterOk := v1.Deployment["non-master"]
-	master, masterOk := v1.Deployment["master"]
-	all, allOk := v1.Deployment["all"]
-
-	overlap := map[string]interface{}{}
-	if masterOk && nonMasterOk {
-		for _, mc := range master.Commands {
-			for _, nonMc := range nonMaster.Commands {
-				if mc == nonMc {
-					overlap[mc] = true
-				}
-			}
-		}
-	}
-
-	for item := range overlap {
-		step := map[string]string{"run": item}
-		v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, step)
-	}
-
-	if nonMasterOk {
-		for _, item := range nonMaster.Commands {
-			if _, isDuplicate := overlap[item]; isDuplicate {
-				continue
-			}
-
-			step := map[string]string{"run": `if [ "${CIRCLE_BRANCH}" != "master" ]; then ` + item + `; fi;`}
-			v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, step)
-		}
-	}
-
-	if masterOk {
-		for _, item := range master.Commands {
-			if _, isDuplicate := overlap[item]; isDuplicate {
-				continue
-			}
-
-			step := map[string]string{"run": `if [ "${CIRCLE_BRANCH}" == "master" ]; then ` + item + `; fi;`}
-			v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, step)
-		}
-	}
-
-	if allOk {
-		branch := all.Branch
-		var command string
-		for _, item := range all.Commands {
-			if branch != "" {
-				command = fmt.Sprintf(`if [ "${CIRCLE_BRANCH}" == "%s" ]; then `+item+`; fi;`, branch)
-			} else {
-				command = item
-			}
-			step := map[string]string{"run": command}
-			v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, step)
-		}
-	}
-	return nil
-}
-
 func addCreateCIArtifactDirsStep(v2 *models.CircleYamlV2) {
 	createCIArtifactsDirsStep := map[string]interface{}{
 		"run": map[string]string{
@@ -331,7 +571,7 @@ func addCreateCIArtifactDirsStep(v2 *models.CircleYamlV2) {
 func addInstallNodeStep(v2 *models.CircleYamlV2) {
 	installNodeStep := map[string]interface{}{
 		"run": map[string]string{
-			"name": "Install node for npm publish",
+			"name": "Install node",
 			"command": `curl -sL https://deb.nodesource.com/setup_10.x | sudo -E bash -
 sudo apt-get install -y nodejs`,
 		},
@@ -360,321 +600,317 @@ func addNPMInstallStep(v2 *models.CircleYamlV2) {
 	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, npmInstallStep)
 }
 
-func addInstallAWSCLIStep(v2 *models.CircleYamlV2) {
-	installAWSCLIStep := map[string]interface{}{
-		"run": map[string]string{
-			"name": "Install awscli for ECR publish",
-			"command": `rm -rf ~/.local
-cd /tmp/ && wget https://bootstrap.pypa.io/get-pip.py && sudo python get-pip.py
-sudo apt-get update
-sudo apt-get install python-dev
-sudo pip install --upgrade awscli
-aws --version`,
-		},
+// addPythonInstallSteps creates a virtualenv, activates it for all later steps,
+// and installs dependencies from requirements*.txt, Pipfile, setup.py or tox.ini into it,
+// caching the virtualenv between builds
+func addPythonInstallSteps(v2 *models.CircleYamlV2, version string) {
+	installCommands := []string{}
+	cacheKeyParts := []string{"v1-python" + version}
+	requirements, _ := filepath.Glob("requirements*.txt")
+	sort.Strings(requirements)
+	for _, file := range requirements {
+		installCommands = append(installCommands, "pip install -r "+file)
+		cacheKeyParts = append(cacheKeyParts, fmt.Sprintf(`{{ checksum "%s" }}`, file))
+	}
+	if _, err := os.Stat("Pipfile"); err == nil {
+		installCommands = append(installCommands, "pip install pipenv", "pipenv install --dev")
+		if _, err := os.Stat("Pipfile.lock"); err == nil {
+			cacheKeyParts = append(cacheKeyParts, `{{ checksum "Pipfile.lock" }}`)
+		} else {
+			cacheKeyParts = append(cacheKeyParts, `{{ checksum "Pipfile" }}`)
+		}
+	}
+	if _, err := os.Stat("setup.py"); err == nil {
+		installCommands = append(installCommands, "pip install -e .")
+		cacheKeyParts = append(cacheKeyParts, `{{ checksum "setup.py" }}`)
+	}
+	if _, err := os.Stat("tox.ini"); err == nil {
+		installCommands = append(installCommands, "pip install tox")
+		cacheKeyParts = append(cacheKeyParts, `{{ checksum "tox.ini" }}`)
+	}
+	if len(installCommands) == 0 {
+		return
 	}
-	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, installAWSCLIStep)
-}
 
-func addCloneCIScriptsStep(v2 *models.CircleYamlV2) {
-	cloneCIScriptsStep := map[string]interface{}{
-		"run": map[string]string{
-			"name":    "Clone ci-scripts",
-			"command": `cd $HOME && git clone --depth 1 -v https://github.com/Clever/ci-scripts.git && cd ci-scripts && git show --oneline -s`,
-		},
+	createVirtualenv := "python3 -m venv venv"
+	if strings.HasPrefix(version, "2.") {
+		createVirtualenv = "sudo pip install virtualenv && virtualenv venv"
 	}
-	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, cloneCIScriptsStep)
-}
+	cacheKey := strings.Join(cacheKeyParts, "-")
 
-func addInstallPSQLStep(v2 *models.CircleYamlV2) {
-	installPSQLStep := map[string]interface{}{
+	addRestoreCacheStep(v2, cacheKey, "v1-python"+version+"-")
+	setupVirtualenvStep := map[string]interface{}{
 		"run": map[string]string{
-			"name":    "Install psql",
-			"command": "sudo apt-get install postgresql",
+			"name": "Set up virtualenv",
+			"command": `[ -d venv ] || ` + createVirtualenv + `
+echo "source $(pwd)/venv/bin/activate" >> $BASH_ENV`,
 		},
 	}
-	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, installPSQLStep)
-}
-
-func addWaitForPostgresStep(v2 *models.CircleYamlV2) {
-	waitForPostgresStep := map[string]interface{}{
+	pipInstallStep := map[string]interface{}{
 		"run": map[string]string{
-			"name": "Wait for postgres database to be ready",
-			"command": `echo Waiting for postgres
-for i in ` + "`seq 1 10`;" + `
-do
-  nc -z localhost 5432 && echo Success && exit 0
-  echo -n .
-  sleep 1
-done
-echo Failed waiting for postgres && exit 1`,
+			"name":    "pip install",
+			"command": strings.Join(installCommands, "\n"),
 		},
 	}
-	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, waitForPostgresStep)
-
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, setupVirtualenvStep, pipInstallStep)
+	addSaveCacheStep(v2, cacheKey, "venv")
 }
 
-func determineWorkingDirectory(appType string) (string, error) {
-	// @TODO: determine decent working directory depending on app type for non-(go, wag, node) apps
-	// go, wag: /go/src/github.com/Clever/catapult
-	// non-wag node: ~/Clever/hubble
-
-	// get repo
-	dir, err := os.Getwd()
-	if err != nil {
-		return "", err
+// addBundleInstallSteps installs gems into vendor/bundle, caching them between builds
+func addBundleInstallSteps(v2 *models.CircleYamlV2) {
+	lockfile := "Gemfile"
+	if _, err := os.Stat("Gemfile.lock"); err == nil {
+		lockfile = "Gemfile.lock"
 	}
+	addCachedInstallSteps(v2, "bundle install", "bundle install --jobs=4 --retry=3 --path vendor/bundle",
+		"v1-bundle", []string{lockfile}, []string{"vendor/bundle"})
+}
 
-	splitDir := strings.Split(dir, "/")
-	if len(splitDir) < 1 {
-		return "", fmt.Errorf("failed to find repo in %s", dir)
+// addJavaInstallSteps downloads maven or gradle dependencies, caching them between builds
+func addJavaInstallSteps(v2 *models.CircleYamlV2) {
+	if _, err := os.Stat("pom.xml"); err == nil {
+		addCachedInstallSteps(v2, "mvn dependency:go-offline", "mvn dependency:go-offline",
+			"v1-maven", []string{"pom.xml"}, []string{"~/.m2"})
+		return
 	}
-	repo := splitDir[len(splitDir)-1]
-	// for microplane compaibility:
-	if repo == "planned" {
-		repo = splitDir[len(splitDir)-3]
+	gradle := "gradle"
+	if _, err := os.Stat("gradlew"); err == nil {
+		gradle = "./gradlew"
 	}
+	addCachedInstallSteps(v2, "gradle dependencies", gradle+" dependencies",
+		"v1-gradle", []string{"build.gradle"}, []string{"~/.gradle"})
+}
 
-	// put together working directory string
-	if appType == GOLANG_APP_TYPE || appType == WAG_APP_TYPE {
-		return fmt.Sprintf("/go/src/github.com/Clever/%s", repo), nil
+// addComposerInstallSteps installs composer packages into vendor, caching them between builds
+func addComposerInstallSteps(v2 *models.CircleYamlV2) {
+	lockfile := "composer.json"
+	if _, err := os.Stat("composer.lock"); err == nil {
+		lockfile = "composer.lock"
 	}
-	return fmt.Sprintf("~/Clever/%s", repo), nil
+	addCachedInstallSteps(v2, "composer install", "composer install -n --prefer-dist",
+		"v1-composer", []string{lockfile}, []string{"vendor"})
 }
 
-// determineImageConstraints returns the constraints for the docker images section of build, including:
-// -- app type (wag, go, node, unknown)
-// -- version of  image base language/library (e.g., go "1.10", node "6")
-// -- database types needed for tests (e.g., mongo, postgresql)
-func determineImageConstraints() models.ImageConstraints {
-	// if node, will have package.json and node.mk (but this is clever-specific) in main project dir
-	// if go, will have golang.mk (but this is clever-specific)
-	// another common occurance is go with node, which for us is mostly wag
-	imageConstraints := models.ImageConstraints{
-		AppType: "unknown",
-	}
-
-	pythonCheckRegexp := regexp.MustCompile(`pylint|python|pep8`)
-	if _, err := os.Stat("./package.json"); err == nil {
-		imageConstraints = models.ImageConstraints{
-			AppType: NODE_APP_TYPE,
-			Version: determineNodeVersion(),
-		}
-	} else if _, err := os.Stat("./swagger.yml"); err == nil {
-		imageConstraints = models.ImageConstraints{
-			AppType: WAG_APP_TYPE,
-			Version: determineGoVersion(),
-		}
-	} else if _, err := os.Stat("./golang.mk"); err == nil {
-		imageConstraints = models.ImageConstraints{
-			AppType: GOLANG_APP_TYPE,
-			Version: determineGoVersion(),
-		}
-	} else if _, err := os.Stat("./node.mk"); err == nil {
-		imageConstraints = models.ImageConstraints{
-			AppType: NODE_APP_TYPE,
-			Version: determineNodeVersion(),
-		}
-	} else if pythonCheckRegexp.Match(makefile) {
-		imageConstraints = models.ImageConstraints{
-			AppType: PYTHON_APP_TYPE,
-			Version: "2.7",
-		}
-	}
-	imageConstraints.DatabaseTypes = determineDatabaseTypes()
-	return imageConstraints
+// addHaskellInstallSteps builds haskell dependencies with stack (or cabal if there is no stack.yaml),
+// caching them between builds
+func addHaskellInstallSteps(v2 *models.CircleYamlV2) {
+	if _, err := os.Stat("stack.yaml"); err == nil {
+		addCachedInstallSteps(v2, "stack build dependencies", "stack setup\nstack build --only-dependencies --test",
+			"v1-stack", []string{"stack.yaml"}, []string{"~/.stack", ".stack-work"})
+		return
+	}
+	cabalFiles, _ := filepath.Glob("*.cabal")
+	sort.Strings(cabalFiles)
+	addCachedInstallSteps(v2, "cabal install dependencies", "cabal update\ncabal install --only-dependencies --enable-tests",
+		"v1-cabal", cabalFiles, []string{"~/.cabal"})
 }
 
-// determineDatabaseTypes returns a set of database types needed for tests
-func determineDatabaseTypes() map[string]struct{} {
-	databaseTypes := map[string]struct{}{}
-	if needsPostgreSQL() {
-		databaseTypes[POSTGRESQL_DB_TYPE] = struct{}{}
+// addCachedInstallSteps adds a step that runs command, surrounded by steps that restore and save
+// paths to and from a cache keyed on the checksums of keyFiles
+func addCachedInstallSteps(v2 *models.CircleYamlV2, name, command, keyPrefix string, keyFiles, paths []string) {
+	keyParts := []string{keyPrefix}
+	for _, file := range keyFiles {
+		keyParts = append(keyParts, fmt.Sprintf(`{{ checksum "%s" }}`, file))
 	}
-	if needsMongoDB() {
-		databaseTypes[MONGO_DB_TYPE] = struct{}{}
+	cacheKey := strings.Join(keyParts, "-")
+
+	addRestoreCacheStep(v2, cacheKey, keyPrefix+"-")
+	installStep := map[string]interface{}{
+		"run": map[string]string{
+			"name":    name,
+			"command": command,
+		},
 	}
-	return databaseTypes
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, installStep)
+	addSaveCacheStep(v2, cacheKey, paths...)
 }
 
-// needsPostgreSQL returns true if tests rely on postgresql, based on these criteria:
-// -- true if a Makefile contains the text `psql`
-// -- true if a file with `test` in the name contains the text `postgres`
-// -- false otherwise
-func needsPostgreSQL() bool {
-	postgresqlCheckRegexp := regexp.MustCompile(`psql`)
-	postgresqlCircleCheckRegexp := regexp.MustCompile(`postgres`)
-	if postgresqlCheckRegexp.Match(makefile) || postgresqlCircleCheckRegexp.Match(circleCI1File) {
-		return true
-	}
-	// check test files for mention of postgres
-	// grep --include=\*test* -rnw . -e "postgres" --exclude-dir={vendor,gen-*}
-	cmd := exec.Command("/bin/sh", "-c", "grep --include=\\*test* -rnw . -e \"postgres\" --exclude-dir={vendor,gen-*}")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if len(string(output)) > 0 {
-			fmt.Printf("\n\n!Warning: failed to check for postgres. Error: %s\n\n", string(output))
-		}
-		return false
+func addRestoreCacheStep(v2 *models.CircleYamlV2, keys ...string) {
+	restoreCacheStep := map[string]interface{}{
+		"restore_cache": map[string]interface{}{
+			"keys": keys,
+		},
 	}
-	return len(string(output)) > 0
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, restoreCacheStep)
 }
 
-// needsMongoDB returns true if tests rely on mongodb, based on these criteria:
-// -- true if Makefile contains the text `MONGO_TEST_DB`
-// -- true if a file with `test` in the name contains the text `Mongo` or `mongo` or `mgo`
-// -- false otherwise
-func needsMongoDB() bool {
-	// check Makefile for MONGO_TEST_DB
-	mongoCheckRegexp := regexp.MustCompile(`MONGO_TEST_DB|mongodb://localhost|mongodb://127.0.0.1`)
-	if mongoCheckRegexp.Match(makefile) {
-		return true
-	}
-	// check test files for mention of mongo
-	// grep --include=\*test* -rnw . -e "[a-z]*[mM]o*n*go" --exclude-dir={vendor,gen-*}
-	cmd := exec.Command("/bin/sh", "-c", "grep --include=\\*test* -rnw . -e \"[a-z]*[mM]o*n*go\" --exclude-dir={vendor,gen-*}")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if len(string(output)) > 0 {
-			fmt.Printf("\n\n!Warning: failed to check for mongo. Error: %s\n\n", string(output))
-		}
-		return false
+func addSaveCacheStep(v2 *models.CircleYamlV2, key string, paths ...string) {
+	saveCacheStep := map[string]interface{}{
+		"save_cache": map[string]interface{}{
+			"key":   key,
+			"paths": paths,
+		},
 	}
-	return len(string(output)) > 0
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, saveCacheStep)
 }
 
-// needsRedis returns true if tests rely on redis, based on these criteria:
-// -- true if a file with `test` in the name contains the text `redis`
-// -- false otherwise
-// @TODO - currently unused, under the theory that any redis-required repo should have "redis" listed in services
-func needsRedis() bool {
-	// check test files for mention of redis
-	// grep --include=\*test* -rnw . -e "[a-z]*redis" --exclude-dir={vendor,gen-*}
-	cmd := exec.Command("/bin/sh", "-c", "grep --include=\\*test* -rnw . -e \"[a-z]*redis\" --exclude-dir={vendor,gen-*}")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if len(string(output)) > 0 {
-			fmt.Printf("\n\n!Warning: failed to check for redis. Error: %s\n\n", string(output))
-		}
-		return false
+func addInstallAWSCLIStep(v2 *models.CircleYamlV2) {
+	installAWSCLIStep := map[string]interface{}{
+		"run": map[string]string{
+			"name": "Install awscli",
+			"command": `rm -rf ~/.local
+cd /tmp/ && wget https://bootstrap.pypa.io/get-pip.py && sudo python get-pip.py
+sudo pip install --upgrade awscli
+aws --version`,
+		},
+	}
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, installAWSCLIStep)
+}
+
+func addCloneCIScriptsStep(v2 *models.CircleYamlV2) {
+	cloneCIScriptsStep := map[string]interface{}{
+		"run": map[string]string{
+			"name":    "Clone ci-scripts",
+			"command": `cd $HOME && git clone --depth 1 -v https://github.com/Clever/ci-scripts.git && cd ci-scripts && git show --oneline -s`,
+		},
 	}
-	return len(string(output)) > 0
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, cloneCIScriptsStep)
 }
 
-// determineGoVersion determines version of go in use for an app
-// this information is in makefile's golang-version-check, e.g.:
-// $(eval $(call golang-version-check,1.10))
-// uses 1.10 as default if version is not found in this way
-func determineGoVersion() string {
-	version := "1.10"
-	versionCheckRegexp := regexp.MustCompile(`golang-version-check,([0-1].[0-9]+)`)
-	versionCheck := versionCheckRegexp.FindSubmatch(makefile)
-	if versionCheck != nil {
-		version = string(versionCheck[1])
-	}
-	return version
+func addSetupRemoteDockerStep(v2 *models.CircleYamlV2) {
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, "setup_remote_docker")
 }
 
-// determineNodeVersion determines version of node for an app
-func determineNodeVersion() string {
-	defaultVersion := "8"
-	versionCheckRegexp := regexp.MustCompile(`NODE_VERSION := "v([0-9]+)"`)
-	versionCheck := versionCheckRegexp.FindSubmatch(makefile)
-	if versionCheck != nil {
-		return string(versionCheck[1])
+// addWaitForServicesStep waits (like dockerize -wait) until each service's probe succeeds, or it accepts connections
+// on its port, failing if they aren't all ready within serviceWaitTimeout
+func addWaitForServicesStep(v2 *models.CircleYamlV2, services []string) {
+	command := fmt.Sprintf("deadline=$(($(date +%%s) + %d))\n", int(serviceWaitTimeout.Seconds()))
+	for _, service := range services {
+		command += fmt.Sprintf(`echo Waiting for %[1]s
+%[2]suntil eval "$probe" >/dev/null 2>&1; do
+  if [ "$(date +%%s)" -ge "$deadline" ]; then echo Timed out waiting for %[1]s && exit 1; fi
+  sleep 1
+done
+`, service, serviceProbe(serviceCatalog[service]))
 	}
-	dockerfile, err := ioutil.ReadFile("Dockerfile")
-	if err != nil {
-		fmt.Printf("error reading dockerfile: %s\n", err.Error())
-	} else {
-		fmt.Println("checking node version in dockerfile")
-		dockerfileVersionCheckRegexp := regexp.MustCompile(`[a-z]*\/?node[a-z]*:([0-9]+)`)
-		dockerfileVersionCheck := dockerfileVersionCheckRegexp.FindSubmatch(dockerfile)
-		if dockerfileVersionCheck != nil {
-			return string(dockerfileVersionCheck[1])
-		}
+	waitForServicesStep := map[string]interface{}{
+		"run": map[string]string{
+			"name":    "Wait for services to be ready (" + strings.Join(services, ", ") + ")",
+			"command": strings.TrimSuffix(command, "\n"),
+		},
 	}
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, waitForServicesStep)
+}
 
-	fmt.Println("checking node version in circle.yml")
-	circleCI1FileVersionCheckRegexp := regexp.MustCompile(`version:[ ]*([0-9])`)
-	circleCI1FileVersionCheck := circleCI1FileVersionCheckRegexp.FindSubmatch(circleCI1File)
-	if circleCI1FileVersionCheck != nil {
-		return string(circleCI1FileVersionCheck[1])
+// serviceProbe returns the commands that set $probe to entry's probe, or to checking its port if it has no probe
+// or the primary image doesn't have the probe's command
+func serviceProbe(entry serviceEntry) string {
+	probe := fmt.Sprintf("probe=%s\n", shellQuote(fmt.Sprintf("nc -z localhost %d", entry.Port)))
+	if entry.Probe == "" {
+		return probe
 	}
+	tool := strings.Fields(entry.Probe)[0]
+	return probe + fmt.Sprintf("if command -v %s >/dev/null; then probe=%s; fi\n", tool, shellQuote(entry.Probe))
+}
 
-	fmt.Println("using default node version")
-	return defaultVersion
+// determineWorkingDirectory returns where the repo is checked out:
+// -- go, wag: in the GOPATH, at the repo's import path, e.g. /go/src/github.com/Clever/catapult
+// -- everything else: in the home directory, under the repo's org, e.g. ~/Clever/hubble
+func determineWorkingDirectory(appType string, location repoLocation) string {
+	// @TODO: determine decent working directory depending on app type for non-(go, wag, node) apps
+	// put together working directory string
+	var workingDir string
+	var evidence []models.Evidence
+	if appType == GOLANG_APP_TYPE || appType == WAG_APP_TYPE {
+		importPath, importPathEvidence := determineImportPath(location)
+		workingDir = fmt.Sprintf("/go/src/%s", importPath)
+		evidence = append(importPathEvidence, models.Evidence{Rule: fmt.Sprintf("%s apps build in the GOPATH", appType)})
+	} else {
+		workingDir = fmt.Sprintf("~/%s/%s", location.Org, location.Repo)
+		evidence = append(location.evidence(), models.Evidence{Rule: fmt.Sprintf("%s apps build in the home directory", appType)})
+	}
+	explain(WORKING_DIRECTORY_DECISION, workingDir, evidence...)
+	return workingDir
 }
 
 // getImage returns the primary image needed for a repo to build, based on app type and version
 func getImage(constraints models.ImageConstraints) models.DockerImage {
 	// @TODO (INFRA-3163): add human-readable image tags/other comments for image, if doable in yaml
 	// @TODO: use SHAs for all images
-	appType := constraints.AppType
-	version := constraints.Version
 	// default image (reproduces CircleCI 1.0 base)
 	defaultImage := models.DockerImage{
 		Image: "circleci/build-image:ubuntu-14.04-XXL-upstart-1189-5614f37",
 	}
 
-	golangImageMap := map[string]models.DockerImage{
-		"1.10": models.DockerImage{Image: "circleci/golang:1.10.3-stretch"}, // "circleci/golang@sha256:4614481a383e55eef504f26f383db1329c285099fde0cfd342c49e5bb9b6c32a"
-		"1.9":  models.DockerImage{Image: "circleci/golang:1.9.7-stretch"},  // "circleci/golang@sha256:c46bee0b60747525d354f219083a46e06c68152f90f3bfb2812d1f232e6a5097"
-		"1.8":  models.DockerImage{Image: "circleci/golang:1.8.7-stretch"},
-	}
-
-	nodeImageMap := map[string]models.DockerImage{
-		"10": models.DockerImage{Image: "circleci/node:10.8.0-stretch"},
-		"8":  models.DockerImage{Image: "circleci/node:8.11.3-stretch"},
-		"6":  models.DockerImage{Image: "circleci/node:6.14.3-stretch"},
-		"5":  models.DockerImage{Image: "circleci/node:6.14.3-stretch"},
-		"4":  models.DockerImage{Image: "circleci/node:6.14.3-stretch"},
-		"0":  models.DockerImage{Image: "circleci/node:6.14.3-stretch"},
-	}
-	pythonImageMap := map[string]models.DockerImage{
-		"2.7": models.DockerImage{Image: "circleci/python:2.7.15"},
-	}
-
-	if appType == GOLANG_APP_TYPE {
-		golangBaseImage, ok := golangImageMap[version]
-		if ok {
-			return golangBaseImage
-		}
-	} else if appType == WAG_APP_TYPE {
-		golangBaseImage, ok := golangImageMap[version]
-		if ok {
-			//@TODO: -node version not actually availabe for go 1.8
-			return models.DockerImage{Image: fmt.Sprintf("%s-node", golangBaseImage.Image)}
-		}
-	} else if appType == NODE_APP_TYPE {
-		nodeBaseImage, ok := nodeImageMap[version]
-		if ok {
-			return nodeBaseImage
-		} else {
-			fmt.Printf("unrecognized node version !%s!\n", version)
-		}
-	} else if appType == PYTHON_APP_TYPE {
-		pythonBaseImage, ok := pythonImageMap[version]
-		if ok {
-			return pythonBaseImage
+	if detector := appDetector(constraints.AppType); detector != nil {
+		if image, ok := detector.Image(constraints.Version); ok {
+			explain(IMAGE_DECISION, image.Image, models.Evidence{Rule: fmt.Sprintf("image for %s %s", constraints.AppType, constraints.Version)})
+			return image
 		}
 	}
-	fmt.Printf("No circleci image selected for app type %s, version %s -- using default\n", constraints.AppType, constraints.Version)
+	warn(WARNING_SEVERITY, FALLBACK_IMAGE_WARNING,
+		fmt.Sprintf("No circleci image selected for app type %s, version %s -- using default", constraints.AppType, constraints.Version),
+		constraints.VersionEvidence...)
+	explain(IMAGE_DECISION, defaultImage.Image, models.Evidence{Rule: fmt.Sprintf("no image for %s %s -- using CircleCI 1.0's default", constraints.AppType, constraints.Version)})
 	return defaultImage
 }
 
 // getDatabaseImages returns a slice of database images that a repo needs to build
-// (over and above its primary, base image) based on database types it uses
-func getDatabaseImages(constraints models.ImageConstraints) []models.DockerImage {
+// (over and above its primary, base image) based on database types it uses (and their versions), and the services they are for
+func getDatabaseImages(constraints models.ImageConstraints) ([]models.DockerImage, []string) {
 
 	dbImages := []models.DockerImage{}
-	var dbImage models.DockerImage
-	var ok bool
-	for dbType, _ := range constraints.DatabaseTypes {
-		dbImage, ok = dbImageMap[dbType]
+	services := []string{}
+	for _, dbType := range orderedDatabaseTypes(constraints.DatabaseTypes) {
+		_, ok := serviceCatalog[dbType]
 		if !ok {
-			fmt.Printf("Error!!! -- cannot find database image for database type %s\n", dbType)
+			warn(ERROR_SEVERITY, UNKNOWN_SERVICE_WARNING, fmt.Sprintf("cannot find database image for database type %s", dbType),
+				constraints.DatabaseEvidence[dbType]...)
+			continue
+		}
+		image := serviceContainer(dbType, constraints)
+		dbImages = append(dbImages, image)
+		services = append(services, dbType)
+		attachedServices = append(attachedServices, models.Service{
+			Name:     dbType,
+			Image:    image.Image,
+			Sources:  constraints.DatabaseSources[dbType],
+			Evidence: constraints.DatabaseEvidence[dbType],
+		})
+	}
+	return dbImages, services
+}
+
+// serviceContainer returns the image for a service in the catalog, with its environment
+func serviceContainer(service string, constraints models.ImageConstraints) models.DockerImage {
+	entry := serviceCatalog[service]
+	image := overrideImage(service, func() models.DockerImage { return serviceImage(service, constraints) })
+	environment := map[string]string{}
+	keys := []string{}
+	for key := range entry.Environment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		environment[key] = entry.Environment[key]
+		explain(ENVIRONMENT_DECISION, fmt.Sprintf("%s %s=%s", service, key, entry.Environment[key]),
+			models.Evidence{Rule: fmt.Sprintf("default for %s containers", service)})
+	}
+	if entry.Credentials != nil {
+		for key, value := range databaseEnvironment(service, entry.Credentials) {
+			environment[key] = value
+		}
+	}
+	if len(environment) > 0 {
+		image.Environment = environment
+	}
+	return image
+}
+
+// machineServiceEvidence returns evidence pointing at a circle.yml machine.services item
+func machineServiceEvidence(item string) models.Evidence {
+	return models.Evidence{File: "circle.yml", Line: valueLine(circleCI1File, []string{"machine", "services"}, item), Rule: "machine.services " + item}
+}
+
+// machineService returns the catalog service for a circle.yml machine.services item, e.g. postgresql for postgresql-9.6,
+// or false if it isn't one
+func machineService(item string) (string, bool) {
+	versionSuffixRegexp := regexp.MustCompile(`[-:@ ]?[0-9][0-9.]*$`)
+	name := versionSuffixRegexp.ReplaceAllString(item, "")
+	for service, entry := range serviceCatalog {
+		if contains(entry.Hints.ServiceNames, name) {
+			return service, true
 		}
-		dbImages = append(dbImages, dbImage)
 	}
-	return dbImages
+	return "", false
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+func TestWaitForServicesStep(t *testing.T) {
+	defer func(timeout time.Duration) { serviceWaitTimeout = timeout }(serviceWaitTimeout)
+	serviceWaitTimeout = time.Second
+	v2 := &models.CircleYamlV2{}
+	addWaitForServicesStep(v2, []string{POSTGRESQL_DB_TYPE})
+	_, command, ok := runCommand(v2.Jobs.Build.Steps[0])
+	if !ok {
+		t.Fatalf("expected a run step, got %v", v2.Jobs.Build.Steps[0])
+	}
+
+	// tools are fakes that log how they were run, so the step uses them instead of any installed ones
+	for _, test := range []struct {
+		name     string
+		tools    []string
+		ready    bool
+		expected string
+	}{
+		{name: "probe succeeds", tools: []string{"pg_isready", "nc"}, ready: true, expected: "pg_isready -h localhost -p 5432"},
+		{name: "probe fails", tools: []string{"pg_isready", "nc"}, expected: "pg_isready -h localhost -p 5432"},
+		{name: "no probe command", tools: []string{"nc"}, ready: true, expected: "nc -z localhost 5432"},
+	} {
+		dir, err := ioutil.TempDir("", "circle-v2-migrate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		status := 1
+		if test.ready {
+			status = 0
+		}
+		for _, tool := range test.tools {
+			script := fmt.Sprintf("#!/bin/sh\necho %s \"$@\" >> %s\nexit %d\n", tool, filepath.Join(dir, "log"), status)
+			if err := ioutil.WriteFile(filepath.Join(dir, tool), []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bash, err := exec.LookPath("bash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(bash, "-c", command)
+		// the fakes, and what the step itself runs (date, sleep)
+		cmd.Env = []string{"PATH=" + dir + ":/bin:/usr/bin"}
+		err = cmd.Run()
+		if (err == nil) != test.ready {
+			t.Errorf("%s: expected ready %v, got error %v", test.name, test.ready, err)
+		}
+		log, _ := ioutil.ReadFile(filepath.Join(dir, "log"))
+		if lines := strings.Split(strings.TrimSpace(string(log)), "\n"); lines[0] != test.expected {
+			t.Errorf("%s: expected the step to run %q, ran %q", test.name, test.expected, lines)
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"syscall"
 )
 
+// circle-v2-migrate's exit codes (see README); this wrapper exits with the same code for each repo
+const EXIT_SUCCESS = 0
+const EXIT_INTERNAL_ERROR = 1
+const EXIT_SUCCESS_WITH_WARNINGS = 3
+const EXIT_UNSUPPORTED_INPUT = 4
+
 func main() {
 	repoName := os.Getenv("MICROPLANE_REPO")
 	if repoName == "" {
@@ -29,13 +38,39 @@ func main() {
 	cpScriptCmd.Run()
 
 	// run circle-v2-migrate script against repo
-	runScriptCmd := exec.Command("./circle-v2-migrate")
+	// the report is written outside the repo (next to microplane's clone) so it isn't committed
+	reportPath := "../circle-v2-migrate-report.json"
+	args := []string{"--report", reportPath}
+	// CIRCLE_V2_MIGRATE_OVERRIDES is the absolute path of an overrides manifest shared by every repo
+	if manifest := os.Getenv("CIRCLE_V2_MIGRATE_OVERRIDES"); manifest != "" {
+		args = append(args, "--overrides", manifest)
+	}
+	runScriptCmd := exec.Command("./circle-v2-migrate", args...)
 	scriptOutput, err := runScriptCmd.CombinedOutput()
 
-	if err != nil {
+	exitCode := EXIT_SUCCESS
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			exitCode = status.ExitStatus()
+		} else {
+			exitCode = EXIT_INTERNAL_ERROR
+		}
+	} else if err != nil {
 		log.Fatalf("%s -- cannot run script (%s): %s\n", repoName, err.Error(), string(scriptOutput))
 	}
-	log.Printf("circle-v2-migrate output: %s\n", string(scriptOutput))
+
+	switch exitCode {
+	case EXIT_SUCCESS, EXIT_SUCCESS_WITH_WARNINGS:
+		log.Printf("circle-v2-migrate output: %s\n", string(scriptOutput))
+		logReportSummary(repoName, reportPath)
+	case EXIT_UNSUPPORTED_INPUT:
+		logReportSummary(repoName, reportPath)
+		log.Printf("%s -- unsupported input, exit code %d: %s\n", repoName, exitCode, string(scriptOutput))
+		os.Exit(exitCode)
+	default:
+		log.Printf("%s -- script failed, exit code %d: %s\n", repoName, exitCode, string(scriptOutput))
+		os.Exit(exitCode)
+	}
 
 	// remove circle-v2-migrate script from repo
 	finalRmScriptCmd := exec.Command("rm", "./circle-v2-migrate")
@@ -45,4 +80,26 @@ func main() {
 	rmBackupCmd := exec.Command("rm", "./circle.yml.bak")
 	rmBackupCmd.Run()
 
+	if exitCode == EXIT_SUCCESS_WITH_WARNINGS {
+		log.Printf("%s -- migrated with warnings, exit code %d\n", repoName, exitCode)
+	}
+	os.Exit(exitCode)
+}
+
+// logReportSummary logs the number of warnings of each severity in a circle-v2-migrate report
+func logReportSummary(repoName, reportPath string) {
+	contents, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		log.Printf("%s -- cannot read migration report: %s\n", repoName, err.Error())
+		return
+	}
+	var report struct {
+		Counts map[string]int `json:"counts"`
+	}
+	if err := json.Unmarshal(contents, &report); err != nil {
+		log.Printf("%s -- cannot parse migration report: %s\n", repoName, err.Error())
+		return
+	}
+	log.Printf("%s -- migration report %s: %d errors, %d warnings, %d info\n",
+		repoName, reportPath, report.Counts["error"], report.Counts["warning"], report.Counts["info"])
 }
@@ -1,7 +1,10 @@
 package models
 
+import "fmt"
+
 // TODO:
 ///   - Support command modifiers (timeout, pwd, environment, parallel, files, background)
+///     (these are parsed into each command list's Modifiers, but not translated)
 
 // CircleYamlV1
 type CircleYamlV1 struct {
@@ -19,8 +22,8 @@ type CircleYamlV1 struct {
 
 // MachinePhase
 type MachinePhase struct {
-	Pre         []string          `yaml:"pre,omitempty"`
-	Post        []string          `yaml:"post,omitempty"`
+	Pre         Commands          `yaml:"pre,omitempty"`
+	Post        Commands          `yaml:"post,omitempty"`
 	Environment map[string]string `yaml:"environment,omitempty"`
 	Timezone    string            `yaml:"timezone,omitempty"`
 	Hosts       map[string]string `yaml:"hosts,omitempty"`
@@ -31,6 +34,19 @@ type MachinePhase struct {
 	Python      VersionInfo       `yaml:"python,omitempty"`
 	GHC         VersionInfo       `yaml:"ghc,omitempty"`
 	Services    []string          `yaml:"services,omitempty"`
+	// Modifiers are the modifiers given for commands in pre and post, keyed by command
+	Modifiers CommandModifiers `yaml:"-"`
+}
+
+// UnmarshalYAML reads the machine settings, and the modifiers given for its commands
+func (m *MachinePhase) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain MachinePhase
+	if err := unmarshal((*plain)(m)); err != nil {
+		return err
+	}
+	var err error
+	m.Modifiers, err = readModifiers(unmarshal, "pre", "post")
+	return err
 }
 
 // VersionInfo is the version of a language installed on the machine
@@ -40,16 +56,150 @@ type VersionInfo struct {
 
 // Phase is made up of 3 steps: pre (before), override (during), and post (after)
 type Phase struct {
-	Pre      []string `yaml:"pre,omitempty"`
-	Override []string `yaml:"override,omitempty"`
-	Post     []string `yaml:"post,omitempty"`
+	Pre      Commands `yaml:"pre,omitempty"`
+	Override Commands `yaml:"override,omitempty"`
+	Post     Commands `yaml:"post,omitempty"`
+	// Modifiers are the modifiers (timeout, pwd, ...) given for commands in this phase, keyed by command
+	Modifiers CommandModifiers `yaml:"-"`
+}
+
+// UnmarshalYAML reads a phase, and the modifiers given for its commands
+func (p *Phase) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Phase
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+	var err error
+	p.Modifiers, err = readModifiers(unmarshal, "pre", "override", "post")
+	return err
+}
+
+// Commands are a list of commands, each either a string or a map from a command to its modifiers, e.g.
+//
+//	override:
+//	  - make test:
+//	      timeout: 600
+//
+// Commands only keeps the commands: the struct holding them reads the modifiers with readModifiers
+type Commands []string
+
+// UnmarshalYAML reads the commands in a list, without their modifiers
+func (c *Commands) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw []interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	commands, _, err := readCommands(raw)
+	*c = commands
+	return err
+}
+
+// CommandModifiers are the modifiers given for commands, keyed by command
+type CommandModifiers map[string]map[string]interface{}
+
+// readModifiers returns the modifiers given for commands in the Commands under each of keys
+func readModifiers(unmarshal func(interface{}) error, keys ...string) (CommandModifiers, error) {
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return nil, err
+	}
+	var all CommandModifiers
+	for _, key := range keys {
+		list, _ := raw[key].([]interface{})
+		_, modifiers, err := readCommands(list)
+		if err != nil {
+			return nil, err
+		}
+		for command, modifier := range modifiers {
+			if all == nil {
+				all = CommandModifiers{}
+			}
+			all[command] = modifier
+		}
+	}
+	return all, nil
+}
+
+func readCommands(raw []interface{}) ([]string, CommandModifiers, error) {
+	commands := []string{}
+	var modifiers CommandModifiers
+	for _, item := range raw {
+		switch command := item.(type) {
+		case string:
+			commands = append(commands, command)
+		case map[interface{}]interface{}:
+			if len(command) != 1 {
+				return nil, nil, fmt.Errorf("expected a command with modifiers to have one key, got %v", command)
+			}
+			for name, commandModifiers := range command {
+				commandString := fmt.Sprintf("%v", name)
+				commands = append(commands, commandString)
+				modifierMap, ok := commandModifiers.(map[interface{}]interface{})
+				if !ok {
+					return nil, nil, fmt.Errorf("expected modifiers for command %q to be a map, got %v", commandString, commandModifiers)
+				}
+				if modifiers == nil {
+					modifiers = CommandModifiers{}
+				}
+				modifiers[commandString] = map[string]interface{}{}
+				for key, value := range modifierMap {
+					modifiers[commandString][fmt.Sprintf("%v", key)] = value
+				}
+			}
+		default:
+			return nil, nil, fmt.Errorf("expected a command to be a string, got %v", item)
+		}
+	}
+	return commands, modifiers, nil
 }
 
 // DeploymentSettings configures when and how to deploy (after tests)
 type DeploymentSettings struct {
-	Branch   string   `yaml:"branch,omitempty"`
+	Branch   Patterns `yaml:"branch,omitempty"`
+	Tag      Patterns `yaml:"tag,omitempty"`
 	Owner    string   `yaml:"owner,omitempty"`
-	Commands []string `yaml:"commands,omitempty"`
+	Commands Commands `yaml:"commands,omitempty"`
+	// Heroku deploys the branch to a heroku app (before running Commands)
+	Heroku *HerokuSettings `yaml:"heroku,omitempty"`
+	// Modifiers are the modifiers given for Commands, keyed by command
+	Modifiers CommandModifiers `yaml:"-"`
+}
+
+// UnmarshalYAML reads a deployment, and the modifiers given for its commands
+func (d *DeploymentSettings) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain DeploymentSettings
+	if err := unmarshal((*plain)(d)); err != nil {
+		return err
+	}
+	var err error
+	d.Modifiers, err = readModifiers(unmarshal, "commands")
+	return err
+}
+
+// HerokuSettings configures a deploy to heroku
+type HerokuSettings struct {
+	Appname string `yaml:"appname,omitempty"`
+}
+
+// Patterns are branch or tag names, each either a literal name or a /regex/
+type Patterns []string
+
+// UnmarshalYAML reads patterns given either as a single string or as a list, e.g.
+//
+//	branch: master
+//	branch: [master, /release-.*/]
+func (p *Patterns) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*p = Patterns{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*p = list
+	return nil
 }
 
 // NotificationSettings configures which webhooks to trigger after tests are complete
@@ -11,8 +11,38 @@ type CircleYamlV2 struct {
 			Steps            []interface{}     `yaml:"steps,omitempty"`
 		} `yaml:"build,omitempty"`
 	} `yaml:"jobs,omitempty"`
+	// Workflows is only needed when the build job has to run for tags, which it doesn't by default
+	Workflows *Workflows `yaml:"workflows,omitempty"`
+}
+
+// Workflows runs the build job, with filters for which branches and tags it runs for
+type Workflows struct {
+	Version int `yaml:"version"`
+	Build   struct {
+		// Jobs are job names, or maps from a job name to its WorkflowJob settings
+		Jobs []interface{} `yaml:"jobs"`
+	} `yaml:"build"`
+}
+
+// WorkflowJob configures when a job in a workflow runs
+type WorkflowJob struct {
+	Filters Filters `yaml:"filters,omitempty"`
+}
+
+// Filters restrict the branches and tags a job runs for
+type Filters struct {
+	Branches *FilterPatterns `yaml:"branches,omitempty"`
+	Tags     *FilterPatterns `yaml:"tags,omitempty"`
+}
+
+// FilterPatterns are branch or tag names, each either a literal name or a /regex/
+type FilterPatterns struct {
+	Only   []string `yaml:"only,omitempty"`
+	Ignore []string `yaml:"ignore,omitempty"`
 }
 
 type DockerImage struct {
 	Image string `yaml:"image,omitempty"`
+	// Environment configures the container, e.g. the user and database a database image creates
+	Environment map[string]string `yaml:"environment,omitempty"`
 }
@@ -0,0 +1,47 @@
+package models
+
+// Overrides correct what the migration detects for a repo, e.g.
+//
+//	app_type: node
+//	version: "8"
+//	services: [redis]
+//	remove_services: [mongo]
+//	images:
+//	  primary: circleci/node:8.11.3-stretch-browsers
+//	skip_helpers: [awscli]
+//	working_directory: ~/Clever/my-repo
+//	steps:
+//	  - name: Seed the database
+//	    command: make seed
+type Overrides struct {
+	// AppType and Version replace the detected app type and language version
+	AppType string `yaml:"app_type,omitempty"`
+	Version string `yaml:"version,omitempty"`
+	// Services are attached even if they aren't detected, and RemoveServices never are
+	Services       []string `yaml:"services,omitempty"`
+	RemoveServices []string `yaml:"remove_services,omitempty"`
+	// Images replace the image of the primary container (keyed by "primary") or of a service (keyed by service)
+	Images map[string]string `yaml:"images,omitempty"`
+	// SkipHelpers are helper steps (e.g. awscli, ci-scripts) that aren't added even if a command needs them
+	SkipHelpers      []string `yaml:"skip_helpers,omitempty"`
+	WorkingDirectory string   `yaml:"working_directory,omitempty"`
+	// Steps are added after the translated test steps
+	Steps []OverrideStep `yaml:"steps,omitempty"`
+}
+
+// OverrideStep is a run step: a command, or a name and a command
+type OverrideStep struct {
+	Name    string `yaml:"name,omitempty"`
+	Command string `yaml:"command"`
+}
+
+// UnmarshalYAML accepts a command on its own as well as a name and a command
+func (s *OverrideStep) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		*s = OverrideStep{Command: command}
+		return nil
+	}
+	type plain OverrideStep
+	return unmarshal((*plain)(s))
+}
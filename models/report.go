@@ -0,0 +1,39 @@
+package models
+
+// Report is a machine-readable summary of a migration, including everything that needs manual follow-up
+type Report struct {
+	Repo          string `json:"repo"`
+	ScriptVersion string `json:"script_version"`
+	// ExitCode is the exit code circle-v2-migrate exited with, which summarizes the outcome
+	ExitCode int      `json:"exit_code"`
+	AppType  string   `json:"app_type"`
+	Version  string   `json:"version,omitempty"`
+	Images   []string `json:"images"`
+	// Services are the service containers that were attached, and where the need for each came from
+	Services []Service `json:"services"`
+	// Requirements are the helper steps (e.g. awscli) that were added, and the commands or detections that needed each
+	Requirements map[string][]Evidence `json:"requirements"`
+	// Counts is the number of warnings of each severity
+	Counts    map[string]int `json:"counts"`
+	Warnings  []Warning      `json:"warnings"`
+	Decisions []Decision     `json:"decisions"`
+}
+
+// Service is a service container attached to the build job
+type Service struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	// Sources are where the need for the service came from, e.g. detected or machine.services
+	Sources  []string   `json:"sources"`
+	Evidence []Evidence `json:"evidence"`
+}
+
+// Warning is something the migration could not translate faithfully
+type Warning struct {
+	// Severity is info, warning or error
+	Severity string `json:"severity"`
+	// Kind groups warnings across repos, e.g. dropped_key or fallback_image
+	Kind     string     `json:"kind"`
+	Message  string     `json:"message"`
+	Evidence []Evidence `json:"evidence,omitempty"`
+}
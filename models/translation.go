@@ -1,8 +1,70 @@
 package models
 
+import "fmt"
+
 // types for translations
 type ImageConstraints struct {
 	AppType       string
 	Version       string
 	DatabaseTypes map[string]struct{}
+	// AppTypeEvidence is why AppType was chosen
+	AppTypeEvidence []Evidence
+	// VersionEvidence is why Version was chosen
+	VersionEvidence []Evidence
+	// DatabaseEvidence is why each of DatabaseTypes is needed
+	DatabaseEvidence map[string][]Evidence
+	// DatabaseSources are where the need for each of DatabaseTypes came from, e.g. detected or machine.services
+	DatabaseSources map[string][]string
+	// DatabaseVersions are the versions of services (needed or not) the repo says it uses
+	DatabaseVersions map[string]string
+	// DatabaseVersionEvidence is why each of DatabaseVersions was chosen
+	DatabaseVersionEvidence map[string][]Evidence
+	// DatabaseVersionLimits are the drivers the repo uses that only support versions older than DatabaseVersions
+	DatabaseVersionLimits map[string][]Evidence
+}
+
+// Evidence is a cue in the repo that a detection is based on
+type Evidence struct {
+	File string `json:"file,omitempty"`
+	// Line is 1-based, or 0 if the evidence is about the whole file (e.g. that it exists)
+	Line int `json:"line,omitempty"`
+	// Column is 1-based, or 0 if the evidence is about a whole line
+	Column int    `json:"column,omitempty"`
+	Rule   string `json:"rule"`
+}
+
+func (e Evidence) String() string {
+	if e.File == "" {
+		return e.Rule
+	}
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Rule)
+	}
+	if e.Column == 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Rule)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Rule)
+}
+
+// Decision is a choice the converter made (e.g. app type, an added step), and the evidence it was based on
+type Decision struct {
+	Kind     string     `json:"kind"`
+	Value    string     `json:"value"`
+	Evidence []Evidence `json:"evidence,omitempty"`
+}
+
+// AppDetection is a detector's guess that a repo is a particular app type
+type AppDetection struct {
+	AppType string
+	// Confidence is between 0 and 1
+	Confidence float64
+	Evidence   []Evidence
+}
+
+// ServiceDetection is a detector's guess that a repo's tests rely on a service, e.g. a database
+type ServiceDetection struct {
+	Service string
+	// Confidence is between 0 and 1
+	Confidence float64
+	Evidence   []Evidence
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+	"github.com/Clever/yaml"
+)
+
+// OVERRIDES_FILE is the optional per-repo file that corrects what the migration detects
+const OVERRIDES_FILE = ".circle-v2-migrate.yml"
+
+// PRIMARY_IMAGE_OVERRIDE is the key in overrides' images for the primary container's image
+const PRIMARY_IMAGE_OVERRIDE = "primary"
+
+const OVERRIDE_SERVICE_SOURCE = "override"
+
+var (
+	// overrides are the manifest's overrides for the repo, with the repo's own overrides file on top
+	overrides     = models.Overrides{}
+	overridesFile = []byte{}
+	// overridesManifest is the path of a manifest of overrides for many repos, keyed by repo name (--overrides)
+	overridesManifest = ""
+	manifestFile      = []byte{}
+	manifestRepo      = ""
+)
+
+// readOverrides reads the repo's entry in overridesManifest (if set) and OVERRIDES_FILE (if the repo has one),
+// and checks that the services, app type and helpers they name exist
+func readOverrides(location repoLocation) error {
+	if overridesManifest != "" {
+		contents, err := ioutil.ReadFile(overridesManifest)
+		if err != nil {
+			return unsupportedInput("cannot read --overrides manifest: %s", err)
+		}
+		manifestFile = contents
+		manifest := map[string]models.Overrides{}
+		if err := yaml.Unmarshal(contents, &manifest); err != nil {
+			return unsupportedInput("%s: %s", overridesManifest, err)
+		}
+		repo := location.Repo
+		if entry, ok := manifest[repo]; ok {
+			if err := validateOverrides(entry, overridesManifest); err != nil {
+				return err
+			}
+			fmt.Printf("using overrides for %s from %s\n", repo, overridesManifest)
+			manifestRepo = repo
+			overrides = entry
+		} else {
+			warn(INFO_SEVERITY, MANUAL_FOLLOW_UP_WARNING,
+				fmt.Sprintf("%s has no overrides for %s -- set --repo if that isn't the repo's name", overridesManifest, repo),
+				location.RepoEvidence)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(OVERRIDES_FILE)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	overridesFile = contents
+	repoOverrides := models.Overrides{}
+	if err := yaml.Unmarshal(contents, &repoOverrides); err != nil {
+		return unsupportedInput("%s: %s", OVERRIDES_FILE, err)
+	}
+	if err := validateOverrides(repoOverrides, OVERRIDES_FILE); err != nil {
+		return err
+	}
+	overrides = mergeOverrides(overrides, repoOverrides)
+	return nil
+}
+
+// mergeOverrides returns base with the keys set in override replacing base's,
+// except images, which are merged by name
+func mergeOverrides(base, override models.Overrides) models.Overrides {
+	if override.AppType != "" {
+		base.AppType = override.AppType
+	}
+	if override.Version != "" {
+		base.Version = override.Version
+	}
+	if len(override.Services) > 0 {
+		base.Services = override.Services
+	}
+	if len(override.RemoveServices) > 0 {
+		base.RemoveServices = override.RemoveServices
+	}
+	if len(override.Images) > 0 {
+		images := map[string]string{}
+		for name, image := range base.Images {
+			images[name] = image
+		}
+		for name, image := range override.Images {
+			images[name] = image
+		}
+		base.Images = images
+	}
+	if len(override.SkipHelpers) > 0 {
+		base.SkipHelpers = override.SkipHelpers
+	}
+	if override.WorkingDirectory != "" {
+		base.WorkingDirectory = override.WorkingDirectory
+	}
+	if len(override.Steps) > 0 {
+		base.Steps = override.Steps
+	}
+	return base
+}
+
+// validateOverrides returns an unsupportedInput error if overrides (from file) names an app type, service or helper
+// that doesn't exist
+func validateOverrides(overrides models.Overrides, file string) error {
+	if overrides.AppType != "" && overrides.AppType != UNKNOWN_APP_TYPE && appDetector(overrides.AppType) == nil {
+		return unsupportedInput("%s: unknown app_type %q", file, overrides.AppType)
+	}
+	for _, list := range [][]string{overrides.Services, overrides.RemoveServices} {
+		for _, service := range list {
+			if _, err := parseServiceList(service); err != nil {
+				return unsupportedInput("%s: %s", file, err)
+			}
+		}
+	}
+	for name := range overrides.Images {
+		if _, ok := serviceCatalog[name]; !ok && name != PRIMARY_IMAGE_OVERRIDE {
+			return unsupportedInput("%s: unknown image %q -- use %s or a service", file, name, PRIMARY_IMAGE_OVERRIDE)
+		}
+	}
+	for _, requirement := range overrides.SkipHelpers {
+		known := false
+		for _, helper := range helpers {
+			known = known || helper.requirement == requirement
+		}
+		if !known {
+			return unsupportedInput("%s: unknown helper %q in skip_helpers", file, requirement)
+		}
+	}
+	return nil
+}
+
+// overrideEvidence returns evidence pointing at a key (e.g. images.primary) in the repo's overrides file,
+// or in the repo's entry in the manifest if the file doesn't set it
+func overrideEvidence(key string) models.Evidence {
+	path := strings.Split(key, ".")
+	if line, found := keyLine(overridesFile, path); found || manifestRepo == "" {
+		return models.Evidence{File: OVERRIDES_FILE, Line: line, Rule: "override " + key}
+	}
+	line, _ := keyLine(manifestFile, append([]string{manifestRepo}, path...))
+	return models.Evidence{File: overridesManifest, Line: line, Rule: fmt.Sprintf("override %s for %s", key, manifestRepo)}
+}
+
+// applyImageConstraintOverrides replaces the detected app type and version
+func applyImageConstraintOverrides(v1 *models.CircleYamlV1, constraints *models.ImageConstraints) {
+	if overrides.AppType != "" && overrides.AppType != constraints.AppType {
+		constraints.AppType = overrides.AppType
+		constraints.AppTypeEvidence = []models.Evidence{overrideEvidence("app_type")}
+		// the detected version was for the detected app type
+		constraints.Version, constraints.VersionEvidence = "", nil
+		if detector := appDetector(constraints.AppType); detector != nil && overrides.Version == "" {
+			repo := &RepoContext{V1: v1, Makefile: makefile, CircleYaml: circleCI1File}
+			constraints.Version, constraints.VersionEvidence = detector.Version(repo)
+		}
+	}
+	if overrides.Version != "" {
+		constraints.Version = overrides.Version
+		constraints.VersionEvidence = []models.Evidence{overrideEvidence("version")}
+	}
+}
+
+// applyServiceOverrides adds and removes services, after they have been detected and listed in circle.yml
+func applyServiceOverrides(constraints *models.ImageConstraints) {
+	added, _ := parseServiceList(strings.Join(overrides.Services, ","))
+	for _, service := range added {
+		addService(constraints, service, OVERRIDE_SERVICE_SOURCE, overrideEvidence("services"))
+	}
+	removed, _ := parseServiceList(strings.Join(overrides.RemoveServices, ","))
+	for _, service := range removed {
+		removeService(constraints, service, overrideEvidence("remove_services").String())
+	}
+}
+
+// overrideImage returns the image overrides set for name (PRIMARY_IMAGE_OVERRIDE or a service), or the image detect
+// chooses if there is none. detect only runs without an override, so its warnings (e.g. a fallback image) aren't reported
+// for an image that isn't used.
+func overrideImage(name string, detect func() models.DockerImage) models.DockerImage {
+	override, ok := overrides.Images[name]
+	if !ok {
+		return detect()
+	}
+	explain(IMAGE_DECISION, override, overrideEvidence("images."+name))
+	return models.DockerImage{Image: override}
+}
+
+// helperSkipped returns true if overrides skip the helper for requirement
+func helperSkipped(requirement string) bool {
+	if contains(overrides.SkipHelpers, requirement) {
+		fmt.Printf("skipping %s helper (%s)\n", requirement, overrideEvidence("skip_helpers"))
+		return true
+	}
+	return false
+}
+
+// addOverrideSteps adds the extra steps from overrides
+func addOverrideSteps(v2 *models.CircleYamlV2) {
+	for _, step := range overrides.Steps {
+		if step.Name == "" {
+			v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, map[string]string{"run": step.Command})
+		} else {
+			v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, map[string]interface{}{
+				"run": map[string]string{"name": step.Name, "command": step.Command},
+			})
+		}
+		explain(STEP_DECISION, step.Command, overrideEvidence("steps"))
+	}
+}
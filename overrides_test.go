@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+func TestMergeOverrides(t *testing.T) {
+	base := models.Overrides{
+		AppType:  NODE_APP_TYPE,
+		Version:  "8",
+		Services: []string{"redis"},
+		Images:   map[string]string{PRIMARY_IMAGE_OVERRIDE: "circleci/node:8", "redis": "redis:3"},
+	}
+	override := models.Overrides{
+		Version:  "10",
+		Services: []string{"postgresql"},
+		Images:   map[string]string{"redis": "redis:4", "postgresql": "circleci/postgres:10"},
+	}
+	expected := models.Overrides{
+		AppType:  NODE_APP_TYPE,
+		Version:  "10",
+		Services: []string{"postgresql"},
+		Images: map[string]string{
+			PRIMARY_IMAGE_OVERRIDE: "circleci/node:8",
+			"redis":                "redis:4",
+			"postgresql":           "circleci/postgres:10",
+		},
+	}
+	if merged := mergeOverrides(base, override); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected %+v, got %+v", expected, merged)
+	}
+	// the base's images aren't changed
+	if base.Images["redis"] != "redis:3" {
+		t.Errorf("expected the base's redis image to stay redis:3, got %s", base.Images["redis"])
+	}
+}
+
+func TestManifestWithoutRepo(t *testing.T) {
+	defer func() {
+		overrides, overridesFile, overridesManifest, manifestFile, manifestRepo = models.Overrides{}, []byte{}, "", []byte{}, ""
+		warnings = []models.Warning{}
+	}()
+	warnings = []models.Warning{}
+	inTempDir(t, func() {
+		manifest := "hubble:\n  app_type: node\n"
+		if err := ioutil.WriteFile("manifest.yml", []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+		overridesManifest = "manifest.yml"
+		if err := readOverrides(repoLocation{Org: "Clever", Repo: "catapult"}); err != nil {
+			t.Fatal(err)
+		}
+		if overrides.AppType != "" || manifestRepo != "" {
+			t.Errorf("expected no overrides for catapult, got %+v for %q", overrides, manifestRepo)
+		}
+		if len(warnings) != 1 || warnings[0].Severity != INFO_SEVERITY || !strings.Contains(warnings[0].Message, "catapult") {
+			t.Errorf("expected an info warning naming catapult, got %+v", warnings)
+		}
+	})
+}
+
+func TestKeyLine(t *testing.T) {
+	contents := []byte("catapult:\n  images:\n    primary: circleci/golang:1.10\n  app_type: go\n")
+	for _, test := range []struct {
+		path          []string
+		expectedLine  int
+		expectedFound bool
+	}{
+		{[]string{"catapult", "images", "primary"}, 3, true},
+		{[]string{"catapult", "app_type"}, 4, true},
+		// the deepest key along a path that isn't all there
+		{[]string{"catapult", "images", "redis"}, 2, false},
+		{[]string{"catapult", "app_type", "version"}, 4, false},
+		{[]string{"hubble", "images"}, 0, false},
+	} {
+		line, found := keyLine(contents, test.path)
+		if line != test.expectedLine || found != test.expectedFound {
+			t.Errorf("%v: expected line %d (found %v), got line %d (found %v)",
+				test.path, test.expectedLine, test.expectedFound, line, found)
+		}
+	}
+}
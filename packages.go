@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// package managers, by the distro of the primary image
+const APT_PACKAGE_MANAGER = "apt"
+const APK_PACKAGE_MANAGER = "apk"
+const YUM_PACKAGE_MANAGER = "yum"
+
+// packageNames maps packages (by their apt name) to their names for other package managers, where they differ
+var packageNames = map[string]map[string]string{
+	"postgresql-client": {YUM_PACKAGE_MANAGER: "postgresql"},
+	"netcat":            {APK_PACKAGE_MANAGER: "netcat-openbsd", YUM_PACKAGE_MANAGER: "nc"},
+	"python-dev":        {APK_PACKAGE_MANAGER: "python2-dev", YUM_PACKAGE_MANAGER: "python-devel"},
+}
+
+// packageManager returns the package manager for an image's distro, based on its name.
+// Most images (including all of CircleCI's language images) are debian or ubuntu.
+func packageManager(image string) string {
+	switch {
+	case strings.Contains(image, "alpine"):
+		return APK_PACKAGE_MANAGER
+	case strings.Contains(image, "centos"), strings.Contains(image, "fedora"), strings.Contains(image, "amazonlinux"):
+		return YUM_PACKAGE_MANAGER
+	default:
+		return APT_PACKAGE_MANAGER
+	}
+}
+
+// packageInstallCommand returns a command that installs packages (by apt name) non-interactively
+// with a package manager, updating its package index once
+func packageInstallCommand(manager string, packages []string) string {
+	names := []string{}
+	for _, pkg := range packages {
+		name := pkg
+		if renamed, ok := packageNames[pkg][manager]; ok {
+			name = renamed
+		}
+		if !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	// alpine images usually run as root, without sudo
+	command := "SUDO=$(command -v sudo || true)\n"
+	switch manager {
+	case APK_PACKAGE_MANAGER:
+		command += "$SUDO apk add --no-cache " + strings.Join(names, " ")
+	case YUM_PACKAGE_MANAGER:
+		command += "$SUDO yum install -y " + strings.Join(names, " ")
+	default:
+		command += "$SUDO apt-get update\n" +
+			"$SUDO env DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends " + strings.Join(names, " ")
+	}
+	return command
+}
+
+// primaryPackageManager returns the package manager for the job's primary image
+func primaryPackageManager(v2 *models.CircleYamlV2) string {
+	if len(v2.Jobs.Build.Docker) == 0 {
+		return APT_PACKAGE_MANAGER
+	}
+	return packageManager(v2.Jobs.Build.Docker[0].Image)
+}
+
+func addInstallPackagesStep(v2 *models.CircleYamlV2, manager string, packages []string) {
+	installPackagesStep := map[string]interface{}{
+		"run": map[string]string{
+			"name":    "Install packages (" + strings.Join(packages, ", ") + ")",
+			"command": packageInstallCommand(manager, packages),
+		},
+	}
+	v2.Jobs.Build.Steps = append(v2.Jobs.Build.Steps, installPackagesStep)
+}
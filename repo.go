@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// used when the repo has no origin remote to take them from
+const DEFAULT_GIT_HOST = "github.com"
+const DEFAULT_ORG = "Clever"
+
+var (
+	// repoFlag is the org and name of the repo, e.g. Clever/catapult (--repo)
+	repoFlag = ""
+	// importPathFlag is the go import path of the repo (--import-path)
+	importPathFlag = ""
+)
+
+// repoLocation is where a repo lives on its git host, and why
+type repoLocation struct {
+	Host string
+	Org  string
+	Repo string
+	// OrgEvidence and RepoEvidence are why Org and Repo were chosen
+	OrgEvidence  models.Evidence
+	RepoEvidence models.Evidence
+}
+
+// remoteURLRegexp matches a git remote URL, e.g. git@github.com:Clever/catapult.git or https://github.com/Clever/catapult,
+// with the host, org (which may have slashes, for nested groups) and repo as submatches
+var remoteURLRegexp = regexp.MustCompile(`^(?:[a-z+]+://)?(?:[^@/]+@)?([^/:]+)(?::[0-9]+)?[:/]+(.+)/([^/]+?)(?:\.git)?/?$`)
+
+// determineRepo returns where the repo being migrated lives, checking these sources in order:
+// -- --repo, e.g. Clever/catapult
+// -- MICROPLANE_REPO (just the repo name)
+// -- the origin remote's URL in .git/config
+// -- the current directory (or, for microplane's planned directories, the directory microplane cloned into)
+// the org defaults to Clever if neither --repo nor the origin remote says
+func determineRepo() (repoLocation, error) {
+	location := repoLocation{
+		Host:        DEFAULT_GIT_HOST,
+		Org:         DEFAULT_ORG,
+		OrgEvidence: models.Evidence{Rule: fmt.Sprintf("no origin remote -- using default org %s", DEFAULT_ORG)},
+	}
+
+	if remote, line := originURL(); remote != "" {
+		if match := remoteURLRegexp.FindStringSubmatch(remote); match != nil {
+			evidence := models.Evidence{File: ".git/config", Line: line, Rule: "origin remote " + redactRemoteURL(remote)}
+			location.Host, location.Org, location.Repo = match[1], match[2], match[3]
+			location.OrgEvidence, location.RepoEvidence = evidence, evidence
+		} else {
+			warn(INFO_SEVERITY, DETECTION_FAILED_WARNING, fmt.Sprintf("unrecognized origin remote URL %s", redactRemoteURL(remote)),
+				models.Evidence{File: ".git/config", Line: line, Rule: "origin remote"})
+		}
+	}
+
+	if repo := os.Getenv("MICROPLANE_REPO"); repo != "" {
+		location.Repo = repo
+		location.RepoEvidence = models.Evidence{Rule: fmt.Sprintf("repo name %s is MICROPLANE_REPO", repo)}
+	}
+
+	if repoFlag != "" {
+		parts := strings.SplitN(repoFlag, "/", 2)
+		evidence := models.Evidence{Rule: "--repo " + repoFlag}
+		location.Org, location.Repo = parts[0], parts[1]
+		location.OrgEvidence, location.RepoEvidence = evidence, evidence
+	}
+
+	if location.Repo == "" {
+		repo, evidence, err := repoNameFromDirectory()
+		if err != nil {
+			return repoLocation{}, err
+		}
+		location.Repo, location.RepoEvidence = repo, evidence
+	}
+	return location, nil
+}
+
+// repoNameFromDirectory returns the name of the repo being migrated, from the current directory
+func repoNameFromDirectory() (string, models.Evidence, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", models.Evidence{}, err
+	}
+
+	splitDir := strings.Split(dir, "/")
+	if len(splitDir) < 1 {
+		return "", models.Evidence{}, fmt.Errorf("failed to find repo in %s", dir)
+	}
+	repo := splitDir[len(splitDir)-1]
+	// for microplane compaibility:
+	if repo == "planned" && len(splitDir) >= 3 {
+		repo = splitDir[len(splitDir)-3]
+		return repo, models.Evidence{Rule: fmt.Sprintf("repo name %s is the third-to-last segment of microplane's %s", repo, dir)}, nil
+	}
+	return repo, models.Evidence{Rule: fmt.Sprintf("repo name %s is the last segment of %s", repo, dir)}, nil
+}
+
+// originURL returns the URL of the origin remote in .git/config, and the line it's on, or "" if there is none
+func originURL() (string, int) {
+	contents, err := ioutil.ReadFile(filepath.Join(".git", "config"))
+	if err != nil {
+		return "", 0
+	}
+	section := ""
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = strings.Join(strings.Fields(line), " ")
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if section == `[remote "origin"]` && len(parts) == 2 && strings.TrimSpace(parts[0]) == "url" {
+			return strings.TrimSpace(parts[1]), i + 1
+		}
+	}
+	return "", 0
+}
+
+// redactRemoteURL returns a remote URL without its user info, which in CI checkouts is often a token,
+// e.g. https://x-access-token:<token>@github.com/Clever/catapult
+func redactRemoteURL(remote string) string {
+	if parsed, err := url.Parse(remote); err == nil && parsed.Scheme != "" && parsed.Host != "" {
+		parsed.User = nil
+		return parsed.String()
+	}
+	// scp-style, e.g. git@github.com:Clever/catapult.git
+	if at := strings.LastIndex(remote, "@"); at >= 0 {
+		return remote[at+1:]
+	}
+	return remote
+}
+
+// goModuleRegexp matches the module path in go.mod
+var goModuleRegexp = regexp.MustCompile(`(?m)^module\s+"?([^"\s]+)"?`)
+
+// importCommentRegexp matches a canonical import comment, e.g. package catapult // import "github.com/Clever/catapult"
+var importCommentRegexp = regexp.MustCompile(`(?m)^package\s+\w+\s*//\s*import\s+"([^"]+)"`)
+
+// determineImportPath returns the go import path of the repo, and why, checking these sources in order:
+// -- --import-path
+// -- the module path in go.mod
+// -- a canonical import comment in a go file at the root of the repo
+// -- the repo's location, e.g. github.com/Clever/catapult
+func determineImportPath(location repoLocation) (string, []models.Evidence) {
+	if importPathFlag != "" {
+		return importPathFlag, []models.Evidence{{Rule: "--import-path " + importPathFlag}}
+	}
+	if importPath, line := readFileSubmatch("go.mod", goModuleRegexp); importPath != "" {
+		return importPath, []models.Evidence{{File: "go.mod", Line: line, Rule: "module " + importPath}}
+	}
+	goFiles, _ := filepath.Glob("*.go")
+	for _, file := range goFiles {
+		if importPath, line := readFileSubmatch(file, importCommentRegexp); importPath != "" {
+			return importPath, []models.Evidence{{File: file, Line: line, Rule: "import comment " + importPath}}
+		}
+	}
+	importPath := fmt.Sprintf("%s/%s/%s", location.Host, location.Org, location.Repo)
+	return importPath, location.evidence()
+}
+
+// evidence returns why the org and repo were chosen, once if it's the same for both
+func (location repoLocation) evidence() []models.Evidence {
+	if location.OrgEvidence == location.RepoEvidence {
+		return []models.Evidence{location.RepoEvidence}
+	}
+	return []models.Evidence{location.OrgEvidence, location.RepoEvidence}
+}
+
+// parseRepoFlag returns an error if --repo isn't an org and a repo name, e.g. Clever/catapult
+func parseRepoFlag(repo string) error {
+	if repo == "" {
+		return nil
+	}
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return fmt.Errorf("--repo must be an org and a repo name, e.g. Clever/catapult, not %q", repo)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// warning severities, from least to most severe
+const INFO_SEVERITY = "info"
+const WARNING_SEVERITY = "warning"
+const ERROR_SEVERITY = "error"
+
+// kinds of warnings in the migration report
+const DROPPED_KEY_WARNING = "dropped_key"
+const UNKNOWN_SERVICE_WARNING = "unknown_service"
+const FALLBACK_IMAGE_WARNING = "fallback_image"
+const UNSUPPORTED_MODIFIER_WARNING = "unsupported_modifier"
+const MANUAL_FOLLOW_UP_WARNING = "manual_follow_up"
+const VERSION_CONFLICT_WARNING = "version_conflict"
+const UNRECOGNIZED_VERSION_WARNING = "unrecognized_version"
+const DETECTION_FAILED_WARNING = "detection_failed"
+const MIGRATION_FAILED_WARNING = "migration_failed"
+const FORKED_PR_SECRETS_WARNING = "forked_pr_secrets"
+const SERVICE_VERSION_MISMATCH_WARNING = "service_version_mismatch"
+
+// warnings are everything found while converting that needs attention, in the order found
+var warnings = []models.Warning{}
+
+// warn prints a warning and records it for the migration report
+func warn(severity, kind, message string, evidence ...models.Evidence) {
+	fmt.Printf("!%s: %s\n", strings.ToUpper(severity), message)
+	warnings = append(warnings, models.Warning{
+		Severity: severity,
+		Kind:     kind,
+		Message:  message,
+		Evidence: evidence,
+	})
+}
+
+// reportDroppedKeys warns about each circle.yml key that is set but not translated to CircleCI 2.0
+func reportDroppedKeys(v1 *models.CircleYamlV1) {
+	dropped := []struct {
+		key string
+		set bool
+	}{
+		{"machine.pre", len(v1.Machine.Pre) > 0},
+		{"machine.post", len(v1.Machine.Post) > 0},
+		{"machine.environment", len(v1.Machine.Environment) > 0},
+		{"machine.timezone", v1.Machine.Timezone != ""},
+		{"machine.hosts", len(v1.Machine.Hosts) > 0},
+		{"checkout", phaseIsSet(v1.Checkout)},
+		{"database", phaseIsSet(v1.Database)},
+		{"notify.webhooks", len(v1.Notify.Webhooks) > 0},
+		{"general.branches", len(v1.General.Branches.Ignore) > 0 || len(v1.General.Branches.Only) > 0},
+		{"general.build_dir", v1.General.BuildDir != ""},
+		{"general.artifacts", len(v1.General.Artifacts) > 0},
+	}
+	for _, key := range dropped {
+		if key.set {
+			warn(WARNING_SEVERITY, DROPPED_KEY_WARNING, fmt.Sprintf("circle.yml %s is not translated", key.key), circleYamlKeyEvidence(key.key))
+		}
+	}
+}
+
+// reportModifiers warns about each command modifier (timeout, pwd, ...) in circle.yml, none of which are translated
+func reportModifiers(v1 *models.CircleYamlV1) {
+	type commandList struct {
+		// path is the list's section of circle.yml, e.g. deployment.<name>.commands
+		path      []string
+		modifiers models.CommandModifiers
+	}
+	lists := []commandList{
+		{[]string{"machine"}, v1.Machine.Modifiers},
+		{[]string{"checkout"}, v1.Checkout.Modifiers},
+		{[]string{"dependencies"}, v1.Dependencies.Modifiers},
+		{[]string{"database"}, v1.Database.Modifiers},
+		{[]string{"compile"}, v1.Compile.Modifiers},
+		{[]string{"test"}, v1.Test.Modifiers},
+	}
+	deployments := []string{}
+	for name := range v1.Deployment {
+		deployments = append(deployments, name)
+	}
+	sort.Strings(deployments)
+	for _, name := range deployments {
+		lists = append(lists, commandList{[]string{"deployment", name, "commands"}, v1.Deployment[name].Modifiers})
+	}
+	for _, list := range lists {
+		name := strings.Join(list.path, ".")
+		commands := []string{}
+		for command := range list.modifiers {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+		for _, command := range commands {
+			modifiers := []string{}
+			for modifier := range list.modifiers[command] {
+				modifiers = append(modifiers, modifier)
+			}
+			sort.Strings(modifiers)
+			for _, modifier := range modifiers {
+				warn(WARNING_SEVERITY, UNSUPPORTED_MODIFIER_WARNING,
+					fmt.Sprintf("%s modifier on %s command `%s` is not translated", modifier, name, command),
+					models.Evidence{File: "circle.yml", Line: valueLine(circleCI1File, list.path, command), Rule: name + " command modifier " + modifier})
+			}
+		}
+	}
+}
+
+func phaseIsSet(phase models.Phase) bool {
+	return len(phase.Pre) > 0 || len(phase.Override) > 0 || len(phase.Post) > 0
+}
+
+// circleYamlKeyEvidence returns evidence pointing at the line in circle.yml of a dotted key, e.g. deployment.master.owner
+func circleYamlKeyEvidence(key string) models.Evidence {
+	line, found := keyLine(circleCI1File, strings.Split(key, "."))
+	if !found {
+		return models.Evidence{File: "circle.yml", Rule: key}
+	}
+	return models.Evidence{File: "circle.yml", Line: line, Rule: key}
+}
+
+// buildReport summarizes the migration of repo into v2, from the decisions and warnings recorded while converting
+func buildReport(repo string, v2 models.CircleYamlV2, exitCode int) models.Report {
+	report := models.Report{
+		Repo:          repo,
+		ScriptVersion: SCRIPT_VERSION,
+		ExitCode:      exitCode,
+		Images:        []string{},
+		Services:      attachedServices,
+		Requirements:  map[string][]models.Evidence{},
+		Counts:        map[string]int{INFO_SEVERITY: 0, WARNING_SEVERITY: 0, ERROR_SEVERITY: 0},
+		Warnings:      warnings,
+		Decisions:     decisions,
+	}
+	for _, decision := range decisions {
+		switch decision.Kind {
+		case APP_TYPE_DECISION:
+			report.AppType = decision.Value
+		case VERSION_DECISION:
+			report.Version = decision.Value
+		case REQUIREMENT_DECISION:
+			report.Requirements[decision.Value] = decision.Evidence
+		}
+	}
+	for _, image := range v2.Jobs.Build.Docker {
+		report.Images = append(report.Images, image.Image)
+	}
+	for _, warning := range warnings {
+		report.Counts[warning.Severity]++
+	}
+	return report
+}
+
+// writeReport writes report as JSON to path, or to stdout if path is "-"
+func writeReport(report models.Report, path string) error {
+	marshalled, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	marshalled = append(marshalled, '\n')
+	if path == "-" {
+		_, err = reportStdout.Write(marshalled)
+		return err
+	}
+	return ioutil.WriteFile(path, marshalled, 0644)
+}
+
+// reportStdout is the real stdout, which is reserved for the report when it is written with --report=-
+// (everything else is printed to stderr in that case)
+var reportStdout = os.Stdout
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// requirements are helper steps that commands or detectors need
+const CI_SCRIPTS_REQUIREMENT = "ci-scripts"
+const REMOTE_DOCKER_REQUIREMENT = "setup_remote_docker"
+const AWSCLI_REQUIREMENT = "awscli"
+const NODE_REQUIREMENT = "node"
+const PSQL_REQUIREMENT = "psql"
+const NETCAT_REQUIREMENT = "netcat"
+
+// where helper steps are added
+const FIRST_PLACEMENT = "first"
+const AFTER_CHECKOUT_PLACEMENT = "after checkout"
+const BEFORE_FIRST_USE_PLACEMENT = "before first use"
+
+// helper is a step (or steps) that is only added to the job if something needs it
+type helper struct {
+	requirement string
+	// commandRegexp matches run commands that need the helper
+	commandRegexp *regexp.Regexp
+	// packages are distro packages (by their apt name) the helper needs, which are installed in one step for all helpers
+	packages []string
+	// add adds the helper's steps, if it needs more than packages
+	add       func(v2 *models.CircleYamlV2)
+	placement string
+	// satisfied returns true if the job already has what the helper provides, e.g. node in a node image
+	satisfied func(v2 *models.CircleYamlV2) bool
+}
+
+// commandPrefix matches the start of a command within a script
+const commandPrefix = `(^|[\s;&|(])`
+
+// helpers are in the order they are added when they go in the same place
+var helpers = []helper{
+	{
+		requirement: CI_SCRIPTS_REQUIREMENT,
+		add:         addCloneCIScriptsStep,
+		placement:   FIRST_PLACEMENT,
+		satisfied:   hasRunStepFunc("Clone ci-scripts"),
+	},
+	{
+		requirement:   REMOTE_DOCKER_REQUIREMENT,
+		commandRegexp: regexp.MustCompile(commandPrefix + `docker\s`),
+		add:           addSetupRemoteDockerStep,
+		placement:     AFTER_CHECKOUT_PLACEMENT,
+		satisfied:     func(v2 *models.CircleYamlV2) bool { return hasStep(v2, "setup_remote_docker") },
+	},
+	{
+		requirement:   NODE_REQUIREMENT,
+		commandRegexp: regexp.MustCompile(commandPrefix + `(npm|node|yarn)\s`),
+		add:           addInstallNodeStep,
+		placement:     BEFORE_FIRST_USE_PLACEMENT,
+		satisfied:     imageHasNode,
+	},
+	{
+		requirement:   PSQL_REQUIREMENT,
+		commandRegexp: regexp.MustCompile(commandPrefix + `psql\s`),
+		packages:      []string{"postgresql-client"},
+		placement:     BEFORE_FIRST_USE_PLACEMENT,
+	},
+	{
+		requirement:   NETCAT_REQUIREMENT,
+		commandRegexp: regexp.MustCompile(commandPrefix + `nc\s`),
+		packages:      []string{"netcat"},
+		placement:     BEFORE_FIRST_USE_PLACEMENT,
+		satisfied:     imageHasNetcat,
+	},
+	{
+		requirement:   AWSCLI_REQUIREMENT,
+		commandRegexp: regexp.MustCompile(commandPrefix + `aws\s`),
+		packages:      []string{"python-dev"},
+		add:           addInstallAWSCLIStep,
+		placement:     BEFORE_FIRST_USE_PLACEMENT,
+		satisfied:     hasRunStepFunc("Install awscli"),
+	},
+}
+
+// need is why a requirement is needed, and the first step that needs it
+type need struct {
+	firstStep int
+	evidence  []models.Evidence
+}
+
+// requirements are the helpers the job needs, keyed by requirement
+type requirements map[string]*need
+
+// add records that the step at index step (in the job's steps) needs requirement
+func (r requirements) add(requirement string, step int, evidence ...models.Evidence) {
+	if r[requirement] == nil {
+		r[requirement] = &need{firstStep: step}
+	}
+	if step < r[requirement].firstStep {
+		r[requirement].firstStep = step
+	}
+	r[requirement].evidence = append(r[requirement].evidence, evidence...)
+}
+
+// addCommandRequirements adds the requirements of each run step, based on the commands it runs
+func addCommandRequirements(v2 *models.CircleYamlV2, requirements requirements) {
+	for i, step := range v2.Jobs.Build.Steps {
+		_, command, ok := runCommand(step)
+		if !ok {
+			continue
+		}
+		for _, helper := range helpers {
+			if helper.commandRegexp == nil {
+				continue
+			}
+			if match := helper.commandRegexp.FindStringSubmatch(command); match != nil {
+				used := strings.TrimSpace(match[0][len(match[1]):])
+				requirements.add(helper.requirement, i, commandEvidence(lineWith(command, match[0]), "command runs "+used))
+			}
+		}
+	}
+}
+
+// addRequiredHelpers adds the steps for each requirement the job doesn't already satisfy,
+// and explains which commands (or detections) needed it
+func addRequiredHelpers(v2 *models.CircleYamlV2, requirements requirements) {
+	type insertion struct {
+		index int
+		steps []interface{}
+	}
+	insertions := []insertion{}
+	packages := []string{}
+	packagesIndex := len(v2.Jobs.Build.Steps)
+	for _, helper := range helpers {
+		need, ok := requirements[helper.requirement]
+		if !ok || (helper.satisfied != nil && helper.satisfied(v2)) || helperSkipped(helper.requirement) {
+			continue
+		}
+		index := need.firstStep
+		switch helper.placement {
+		case FIRST_PLACEMENT:
+			index = 0
+		case AFTER_CHECKOUT_PLACEMENT:
+			index = stepIndex(v2, "checkout") + 1
+		}
+		explain(REQUIREMENT_DECISION, helper.requirement, need.evidence...)
+		for _, pkg := range helper.packages {
+			if !contains(packages, pkg) {
+				packages = append(packages, pkg)
+			}
+		}
+		if len(helper.packages) > 0 && index < packagesIndex {
+			packagesIndex = index
+		}
+		if helper.add == nil {
+			continue
+		}
+		scratch := models.CircleYamlV2{}
+		helper.add(&scratch)
+		insertions = append(insertions, insertion{index: index, steps: scratch.Jobs.Build.Steps})
+	}
+	// all packages are installed in one step, before any helper that needs them
+	if len(packages) > 0 {
+		scratch := models.CircleYamlV2{}
+		addInstallPackagesStep(&scratch, primaryPackageManager(v2), packages)
+		insertions = append([]insertion{{index: packagesIndex, steps: scratch.Jobs.Build.Steps}}, insertions...)
+	}
+
+	// insert from the end, so indexes stay valid; helpers at the same index keep their order
+	sort.SliceStable(insertions, func(i, j int) bool { return insertions[i].index > insertions[j].index })
+	for i := 0; i < len(insertions); {
+		index := insertions[i].index
+		group := []interface{}{}
+		for ; i < len(insertions) && insertions[i].index == index; i++ {
+			group = append(group, insertions[i].steps...)
+		}
+		steps := append([]interface{}{}, v2.Jobs.Build.Steps[:index]...)
+		steps = append(steps, group...)
+		v2.Jobs.Build.Steps = append(steps, v2.Jobs.Build.Steps[index:]...)
+	}
+}
+
+// commandEvidence returns evidence pointing at the line in circle.yml with text, or just rule if there is none
+// (e.g. because the command was generated)
+func commandEvidence(text, rule string) models.Evidence {
+	line := lineContaining(circleCI1File, text)
+	if line == 0 {
+		return models.Evidence{Rule: rule}
+	}
+	return models.Evidence{File: "circle.yml", Line: line, Rule: rule}
+}
+
+// lineWith returns the line of script that contains s
+func lineWith(script, s string) string {
+	for _, line := range strings.Split(script, "\n") {
+		if strings.Contains(line, strings.TrimSpace(s)) {
+			return strings.TrimSpace(line)
+		}
+	}
+	return script
+}
+
+// stepIndex returns the index of the step that is just name (e.g. "checkout"), or -1 if there is none
+func stepIndex(v2 *models.CircleYamlV2, name string) int {
+	for i, step := range v2.Jobs.Build.Steps {
+		if step == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasStep returns true if the job has a step that is just name, e.g. "checkout"
+func hasStep(v2 *models.CircleYamlV2, name string) bool {
+	return stepIndex(v2, name) >= 0
+}
+
+// hasRunStepFunc returns a function that returns true if the job has a run step whose name starts with name
+func hasRunStepFunc(name string) func(v2 *models.CircleYamlV2) bool {
+	return func(v2 *models.CircleYamlV2) bool {
+		for _, step := range v2.Jobs.Build.Steps {
+			if stepName, _, ok := runCommand(step); ok && strings.HasPrefix(stepName, name) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// imageHasNode returns true if the job's primary image has node installed:
+// node images, images with a -node variant, and the CircleCI 1.0 build image
+func imageHasNode(v2 *models.CircleYamlV2) bool {
+	if len(v2.Jobs.Build.Docker) == 0 {
+		return false
+	}
+	image := v2.Jobs.Build.Docker[0].Image
+	return strings.Contains(image, "node") || strings.Contains(image, "build-image")
+}
+
+// imageHasNetcat returns true if the primary image has nc, as CircleCI's convenience images do
+func imageHasNetcat(v2 *models.CircleYamlV2) bool {
+	return len(v2.Jobs.Build.Docker) > 0 && strings.HasPrefix(v2.Jobs.Build.Docker[0].Image, "circleci/")
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+// serviceVersionHints are how a repo says which version of a service it uses
+type serviceVersionHints struct {
+	// ImageNames are docker image names for the service, e.g. postgres in `image: postgres:9.6` or `FROM postgres:9.6`
+	ImageNames []string
+	// ServiceNames are names of the service in circle.yml's machine.services, e.g. postgresql in postgresql-9.6
+	ServiceNames []string
+	// PackagePattern matches a distro package for the service in an install command, with the version as its submatch
+	PackagePattern string
+	// Drivers are client libraries that imply a version of the service
+	Drivers []serviceDriver
+}
+
+// serviceDriver is a client library for a service, declared in a dependency file
+type serviceDriver struct {
+	// File is package.json or Gopkg.lock
+	File string
+	Name string
+	// Versions maps the driver's major version (or "" for any version) to the service version it implies
+	Versions map[string]string
+}
+
+// dockerComposeFiles are where repos that use docker-compose for local development declare their services
+var dockerComposeFiles = []string{"docker-compose.yml", "docker-compose.yaml", "docker-compose.*.yml", "docker-compose.*.yaml"}
+
+// determineDatabaseVersions returns the version of each service in the catalog the repo says it uses, and why
+// (followed by evidence for any other versions it says), checking these sources in order:
+// -- images in docker-compose files, e.g. `image: postgres:9.6`
+// -- the Dockerfile's base image, or packages it installs
+// -- `apt-get install postgresql-9.6` (or similar) commands in circle.yml
+// -- versioned machine.services entries in circle.yml, e.g. postgresql-9.6
+// drivers for the service in package.json or Gopkg.lock limit the version instead: without a version from the sources
+// above, the version is the newest all the drivers support, and otherwise drivers that don't support it are returned
+// as its limits
+func determineDatabaseVersions(repo *RepoContext) (map[string]string, map[string][]models.Evidence, map[string][]models.Evidence) {
+	versions := map[string]string{}
+	versionEvidence := map[string][]models.Evidence{}
+	versionLimits := map[string][]models.Evidence{}
+	services := []string{}
+	for service := range serviceCatalog {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		hints := serviceCatalog[service].Hints
+		sources := findServiceVersions(repo, service, hints)
+		limits := findDriverLimits(service, hints)
+		if len(sources) == 0 && len(limits) > 0 {
+			newest := limits[0]
+			for _, limit := range limits[1:] {
+				if versionNumber(limit.version) < versionNumber(newest.version) {
+					newest = limit
+				}
+			}
+			sources = []versionSource{newest}
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		// disagreeing sources are kept as evidence, so they can be reported if the service is used
+		versions[service] = sources[0].version
+		versionEvidence[service] = []models.Evidence{sources[0].evidence}
+		for _, source := range sources[1:] {
+			if source.version != sources[0].version {
+				versionEvidence[service] = append(versionEvidence[service], source.evidence)
+			}
+		}
+		for _, limit := range limits {
+			if versionNumber(limit.version) < versionNumber(versions[service]) {
+				versionLimits[service] = append(versionLimits[service], limit.evidence)
+			}
+		}
+	}
+	return versions, versionEvidence, versionLimits
+}
+
+// findServiceVersions returns every version of service declared in the repo, in order of precedence
+func findServiceVersions(repo *RepoContext, service string, hints serviceVersionHints) []versionSource {
+	candidates := []versionCandidate{}
+	if len(hints.ImageNames) > 0 {
+		imagePattern := `(?:[a-z0-9.-]+/)*(?:` + strings.Join(hints.ImageNames, "|") + `):v?([0-9][0-9.]*)`
+		for _, pattern := range dockerComposeFiles {
+			matches, _ := filepath.Glob(pattern)
+			for _, file := range matches {
+				candidates = append(candidates, fileCandidate(file, `image:\s*["']?`+imagePattern, service+" image"))
+			}
+		}
+		candidates = append(candidates, fileCandidate("Dockerfile", `(?i)FROM\s+`+imagePattern, service+" base image"))
+	}
+	if hints.PackagePattern != "" {
+		candidates = append(candidates, fileCandidate("Dockerfile", hints.PackagePattern, service+" package"))
+		packageRegexp := regexp.MustCompile(`\binstall\b.*\b` + hints.PackagePattern)
+		for _, command := range v1Commands(repo.V1) {
+			if match := packageRegexp.FindStringSubmatch(command); match != nil {
+				candidates = append(candidates, circleYamlCommandCandidate(repo, match[1], command))
+			}
+		}
+	}
+	if len(hints.ServiceNames) > 0 {
+		serviceRegexp := regexp.MustCompile(`^(?:` + strings.Join(hints.ServiceNames, "|") + `)[-:@ ]?([0-9][0-9.]*)$`)
+		for _, item := range repo.V1.Machine.Services {
+			if match := serviceRegexp.FindStringSubmatch(item); match != nil {
+				candidates = append(candidates, versionCandidate{raw: match[1], evidence: machineServiceEvidence(item)})
+			}
+		}
+	}
+	return findVersions(service, serviceMinorVersion, candidates...)
+}
+
+// findDriverLimits returns the newest version of service each driver for it in the repo supports
+func findDriverLimits(service string, hints serviceVersionHints) []versionSource {
+	candidates := []versionCandidate{}
+	for _, driver := range hints.Drivers {
+		candidates = append(candidates, driverCandidate(driver, service))
+	}
+	return findVersions(service, serviceMinorVersion, candidates...)
+}
+
+// driverCandidate returns the service version a driver in package.json or Gopkg.lock implies, as a version candidate
+func driverCandidate(driver serviceDriver, service string) versionCandidate {
+	contents, err := ioutil.ReadFile(driver.File)
+	if err != nil {
+		return versionCandidate{}
+	}
+	driverVersion := ""
+	switch driver.File {
+	case "package.json":
+		var pkg struct {
+			Dependencies    map[string]string `json:"dependencies"`
+			DevDependencies map[string]string `json:"devDependencies"`
+		}
+		if err := json.Unmarshal(contents, &pkg); err != nil {
+			return versionCandidate{}
+		}
+		raw, ok := pkg.Dependencies[driver.Name]
+		if !ok {
+			if raw, ok = pkg.DevDependencies[driver.Name]; !ok {
+				return versionCandidate{}
+			}
+		}
+		if driverVersion, ok = nodeMajorVersion(raw); !ok {
+			return versionCandidate{}
+		}
+	default:
+		// Gopkg.lock lists each dependency as name = "<import path>"
+		if lineContaining(contents, fmt.Sprintf("name = %q", driver.Name)) == 0 {
+			return versionCandidate{}
+		}
+	}
+	version, ok := driver.Versions[driverVersion]
+	if !ok {
+		version, ok = driver.Versions[""]
+	}
+	if !ok {
+		return versionCandidate{}
+	}
+	name := driver.Name
+	if driverVersion != "" {
+		name += " " + driverVersion
+	}
+	return versionCandidate{
+		raw: version,
+		evidence: models.Evidence{
+			File: driver.File,
+			Line: lineContaining(contents, `"`+driver.Name+`"`),
+			Rule: fmt.Sprintf("driver %s supports %s up to", name, service),
+		},
+	}
+}
+
+// serviceMinorVersion returns the major.minor (or just major) version from a service version,
+// e.g. "9.6.3" -> "9.6", "10" -> "10", "3.4.1-jessie" -> "3.4"
+func serviceMinorVersion(raw string) (string, bool) {
+	versionRegexp := regexp.MustCompile(`^v?([0-9]+)(?:\.([0-9]+))?`)
+	version := versionRegexp.FindStringSubmatch(strings.TrimSpace(raw))
+	if version == nil {
+		return "", false
+	}
+	if version[2] == "" {
+		return version[1], true
+	}
+	return version[1] + "." + version[2], true
+}
+
+// serviceImage returns the catalog image for a service: the image for the version closest to the one the repo uses,
+// or the service's default image if the repo doesn't say. Reports when the image's version differs from the repo's.
+func serviceImage(service string, constraints models.ImageConstraints) models.DockerImage {
+	entry := serviceCatalog[service]
+	version, ok := constraints.DatabaseVersions[service]
+	if !ok {
+		return entry.Image
+	}
+	evidence := constraints.DatabaseVersionEvidence[service]
+	explain(SERVICE_VERSION_DECISION, fmt.Sprintf("%s %s", service, version), evidence[0])
+	for _, conflicting := range evidence[1:] {
+		warn(WARNING_SEVERITY, VERSION_CONFLICT_WARNING,
+			fmt.Sprintf("conflicting %s versions: %s, %s -- using %s", service, evidence[0], conflicting, version),
+			evidence[0], conflicting)
+	}
+	evidence = evidence[:1]
+	for _, limit := range constraints.DatabaseVersionLimits[service] {
+		warn(WARNING_SEVERITY, SERVICE_VERSION_MISMATCH_WARNING,
+			fmt.Sprintf("repo uses %s %s, but %s -- check that tests pass with it", service, version, limit.Rule),
+			evidence[0], limit)
+	}
+	if len(entry.Versions) == 0 {
+		warn(INFO_SEVERITY, SERVICE_VERSION_MISMATCH_WARNING,
+			fmt.Sprintf("repo uses %s %s, but only %s is available -- check that tests pass with it", service, version, entry.Image.Image),
+			evidence...)
+		return entry.Image
+	}
+
+	closest := closestVersion(version, entry.Versions)
+	image := entry.Versions[closest]
+	if closest != version && !strings.HasPrefix(version, closest+".") {
+		warn(WARNING_SEVERITY, SERVICE_VERSION_MISMATCH_WARNING,
+			fmt.Sprintf("repo uses %s %s, but the closest image is %s (%s) -- check that tests pass with it", service, version, closest, image.Image),
+			evidence...)
+	}
+	explain(IMAGE_DECISION, image.Image, models.Evidence{Rule: fmt.Sprintf("closest image to %s %s", service, version)})
+	return image
+}
+
+// closestVersion returns the version in versions nearest to version, preferring the newer of two equally near versions
+func closestVersion(version string, versions map[string]models.DockerImage) string {
+	target := versionNumber(version)
+	closest, closestDistance := "", -1
+	for candidate := range versions {
+		number := versionNumber(candidate)
+		distance := number - target
+		if distance < 0 {
+			distance = -distance
+		}
+		if closestDistance < 0 || distance < closestDistance ||
+			(distance == closestDistance && number > versionNumber(closest)) {
+			closest, closestDistance = candidate, distance
+		}
+	}
+	return closest
+}
+
+// versionNumber returns a major.minor version as a number that orders and spaces versions, e.g. "9.6" -> 906, "10" -> 1000,
+// ignoring any patch version
+func versionNumber(version string) int {
+	parts := strings.SplitN(version, ".", 3)
+	major, _ := strconv.Atoi(parts[0])
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major*100 + minor
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+func TestVersionNumber(t *testing.T) {
+	for _, test := range []struct {
+		version  string
+		expected int
+	}{
+		{"9.6", 906},
+		{"10", 1000},
+		{"3.4", 304},
+		{"3.10", 310},
+		{"9.6.3", 906},
+	} {
+		if number := versionNumber(test.version); number != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.version, test.expected, number)
+		}
+	}
+}
+
+func TestClosestVersion(t *testing.T) {
+	versions := map[string]models.DockerImage{"9.4": {}, "9.5": {}, "9.6": {}, "10": {}, "11": {}}
+	for _, test := range []struct {
+		version  string
+		expected string
+	}{
+		{"9.5", "9.5"},
+		{"9.6.3", "9.6"},
+		{"10.4", "10"},
+		{"9.3", "9.4"},
+		{"12", "11"},
+		// 10.50 is as near 10 as 11, so the newer is used
+		{"10.50", "11"},
+	} {
+		if closest := closestVersion(test.version, versions); closest != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.version, test.expected, closest)
+		}
+	}
+}
+
+func TestDriverVersionLimits(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		dockerCompose  string
+		packageJSON    string
+		version        string
+		conflicts      int
+		expectedLimits int
+	}{
+		{
+			name:        "driver without another source",
+			packageJSON: `{"dependencies": {"mongoose": "^4.13.0"}}`,
+			version:     "3.4",
+		},
+		{
+			name:        "the newest version every driver supports",
+			packageJSON: `{"dependencies": {"mongoose": "^5.0.0", "mongodb": "^2.2.0"}}`,
+			version:     "3.4",
+		},
+		{
+			name:          "older than the driver supports",
+			dockerCompose: "services:\n  mongo:\n    image: mongo:3.2\n",
+			packageJSON:   `{"dependencies": {"mongoose": "^5.0.0"}}`,
+			version:       "3.2",
+		},
+		{
+			name:           "newer than the driver supports",
+			dockerCompose:  "services:\n  mongo:\n    image: mongo:4.0\n",
+			packageJSON:    `{"dependencies": {"mongoose": "^4.13.0"}}`,
+			version:        "4.0",
+			expectedLimits: 1,
+		},
+	} {
+		inTempDir(t, func() {
+			if test.dockerCompose != "" {
+				if err := ioutil.WriteFile("docker-compose.yml", []byte(test.dockerCompose), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile("package.json", []byte(test.packageJSON), 0644); err != nil {
+				t.Fatal(err)
+			}
+			versions, evidence, limits := determineDatabaseVersions(&RepoContext{V1: &models.CircleYamlV1{}})
+			if versions[MONGO_DB_TYPE] != test.version {
+				t.Errorf("%s: expected version %s, got %s", test.name, test.version, versions[MONGO_DB_TYPE])
+			}
+			// drivers aren't conflicting sources
+			if len(evidence[MONGO_DB_TYPE]) != 1 {
+				t.Errorf("%s: expected one source, got %v", test.name, evidence[MONGO_DB_TYPE])
+			}
+			if len(limits[MONGO_DB_TYPE]) != test.expectedLimits {
+				t.Errorf("%s: expected %d limits, got %v", test.name, test.expectedLimits, limits[MONGO_DB_TYPE])
+			}
+		})
+	}
+}
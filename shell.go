@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const INVALID_SHELL_WARNING = "invalid_shell"
+
+// run steps use bash in CircleCI 2.0 images
+var shellParser = syntax.NewParser(syntax.Variant(syntax.LangBash), syntax.KeepComments(true))
+var shellPrinter = syntax.NewPrinter(syntax.Indent(2))
+
+// guardCommand returns a script that only runs command if guard succeeds, or command itself if there's no guard, e.g.
+//
+//	if [ "${CIRCLE_BRANCH}" = "master" ]; then
+//	  make publish
+//	fi
+//
+// Both are parsed and printed as shell, so commands that are multi-line, end in `&` or `;`, or mention `fi` are
+// guarded correctly. If either doesn't parse, they are combined as text, and validateRunCommands reports the step.
+func guardCommand(guard, command string) string {
+	if guard == "" {
+		return command
+	}
+	fallback := "if " + guard + "; then\n" + command + "\nfi"
+	cond, err := parseShell(guard)
+	if err != nil {
+		return fallback
+	}
+	body, err := parseShell(command)
+	if err != nil {
+		return fallback
+	}
+	// the parts are printed separately first, since printing nodes from different parses together mixes up their positions
+	script, err := parseShell("if " + strings.TrimSpace(printShell(cond)) + "; then\n" + printShell(body) + "fi\n")
+	if err != nil {
+		return fallback
+	}
+	return strings.TrimSuffix(printShell(script), "\n")
+}
+
+func parseShell(script string) (*syntax.File, error) {
+	return shellParser.Parse(strings.NewReader(script), "")
+}
+
+func printShell(file *syntax.File) string {
+	var buf bytes.Buffer
+	shellPrinter.Print(&buf, file)
+	return buf.String()
+}
+
+// shellQuote returns s as a double-quoted shell word, or quoted however bash needs if s has special characters
+func shellQuote(s string) string {
+	if !strings.ContainsAny(s, "\"$`\\!") {
+		return `"` + s + `"`
+	}
+	quoted, err := syntax.Quote(s, syntax.LangBash)
+	if err != nil {
+		return fmt.Sprintf("%q", s)
+	}
+	return quoted
+}
+
+// validateRunCommands reports each run step whose command doesn't parse as shell
+func validateRunCommands(v2 *models.CircleYamlV2) {
+	for _, step := range v2.Jobs.Build.Steps {
+		name, command, ok := runCommand(step)
+		if !ok {
+			continue
+		}
+		if _, err := parseShell(command); err != nil {
+			firstLine := strings.SplitN(command, "\n", 2)[0]
+			if name == "" {
+				name = firstLine
+			}
+			// point at the command in circle.yml, if it came from there (a guard may have been added before it)
+			evidence := models.Evidence{Rule: "run command parses as shell"}
+			for _, commandLine := range strings.Split(command, "\n") {
+				if line := lineContaining(circleCI1File, strings.TrimSpace(commandLine)); line > 0 {
+					evidence.File, evidence.Line = "circle.yml", line
+					break
+				}
+			}
+			warn(ERROR_SEVERITY, INVALID_SHELL_WARNING, fmt.Sprintf("run step `%s` is not valid shell: %s", name, err), evidence)
+		}
+	}
+}
+
+// runCommand returns the name (if any) and command of a run step, or false if step isn't a run step
+func runCommand(step interface{}) (string, string, bool) {
+	var run interface{}
+	switch s := step.(type) {
+	case map[string]string:
+		run = s["run"]
+	case map[string]interface{}:
+		run = s["run"]
+	default:
+		return "", "", false
+	}
+	switch r := run.(type) {
+	case string:
+		return "", r, true
+	case map[string]string:
+		return r["name"], r["command"], true
+	}
+	return "", "", false
+}
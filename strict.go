@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Clever/circle-v2-migrate/models"
+	"github.com/Clever/yaml"
+	// the Clever yaml fork doesn't expose node positions, which are needed to point at unknown keys
+	yamlnode "gopkg.in/yaml.v3"
+)
+
+const UNKNOWN_KEY_WARNING = "unknown_key"
+const UNMODELED_KEY_WARNING = "unmodeled_key"
+
+// unmodeledKeys are valid CircleCI 1.0 keys that models.CircleYamlV1 doesn't have a field for,
+// so they would otherwise be silently ignored. `*` matches any key, e.g. a deployment name.
+var unmodeledKeys = []string{
+	"experimental",
+	"machine.xcode",
+	"dependencies.cache_directories",
+	"dependencies.bundler",
+	"test.minitest_globs",
+	"notify.*",
+	"deployment.*.codedeploy",
+}
+
+// reportUnknownKeys warns about each key in circle.yml that isn't read into models.CircleYamlV1,
+// with its line and column. It returns the number of keys that aren't CircleCI 1.0 keys at all
+// (e.g. misspellings), as opposed to valid keys that aren't modeled.
+func reportUnknownKeys() int {
+	var root yamlnode.Node
+	if err := yamlnode.Unmarshal(circleCI1File, &root); err != nil {
+		// the lenient parse succeeded, so don't fail the migration over the strict one
+		warn(WARNING_SEVERITY, DETECTION_FAILED_WARNING, fmt.Sprintf("failed to check circle.yml for unknown keys. Error: %s", err))
+		return 0
+	}
+	unknown := 0
+	checkKeys(&root, reflect.TypeOf(models.CircleYamlV1{}), nil, &unknown)
+	return unknown
+}
+
+// checkUnknownKeys reports the keys in circle.yml that aren't read (see reportUnknownKeys), returning an
+// unsupportedInput error if strict and any of them aren't CircleCI 1.0 keys
+func checkUnknownKeys(strict bool) error {
+	if unknown := reportUnknownKeys(); unknown > 0 && strict {
+		return unsupportedInput("circle.yml has %d unknown key(s)", unknown)
+	}
+	return nil
+}
+
+// checkKeys compares the keys of node to the fields of t, recursing into structs and maps
+func checkKeys(node *yamlnode.Node, t reflect.Type, path []string, unknown *int) {
+	if node.Kind == yamlnode.DocumentNode {
+		for _, child := range node.Content {
+			checkKeys(child, t, path, unknown)
+		}
+		return
+	}
+	// type mismatches are left to the lenient parse, and commands in lists may have modifiers, which reportModifiers checks
+	if node.Kind != yamlnode.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		keyPath := append(append([]string{}, path...), key.Value)
+		switch t.Kind() {
+		case reflect.Map:
+			checkKeys(value, t.Elem(), keyPath, unknown)
+		case reflect.Struct:
+			if field, ok := yamlField(t, key.Value); ok {
+				checkKeys(value, field.Type, keyPath, unknown)
+				continue
+			}
+			dotted := strings.Join(keyPath, ".")
+			evidence := models.Evidence{File: "circle.yml", Line: key.Line, Column: key.Column, Rule: dotted}
+			if isUnmodeledKey(keyPath) {
+				warn(WARNING_SEVERITY, UNMODELED_KEY_WARNING,
+					fmt.Sprintf("circle.yml:%d:%d: %s is not supported by circle-v2-migrate, and is not translated", key.Line, key.Column, dotted), evidence)
+			} else {
+				warn(WARNING_SEVERITY, UNKNOWN_KEY_WARNING,
+					fmt.Sprintf("circle.yml:%d:%d: %s is not a CircleCI 1.0 key, and is ignored", key.Line, key.Column, dotted), evidence)
+				*unknown++
+			}
+		}
+	}
+}
+
+// yamlField returns the field of struct type t that the yaml key is read into
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if name == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// isUnmodeledKey returns true if keyPath matches one of unmodeledKeys
+func isUnmodeledKey(keyPath []string) bool {
+	for _, pattern := range unmodeledKeys {
+		segments := strings.Split(pattern, ".")
+		if len(segments) != len(keyPath) {
+			continue
+		}
+		matches := true
+		for i, segment := range segments {
+			if segment != "*" && segment != keyPath[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+var yamlErrorLineRegexp = regexp.MustCompile(`line (\d+): (.*)`)
+
+// circleYamlParseError rewrites a yaml error for circle.yml to point at each offending line, e.g.
+//
+//	circle.yml:3: cannot unmarshal !!map into []string
+//	  3 | services: {postgresql: true}
+func circleYamlParseError(err error) error {
+	lines := bytes.Split(circleCI1File, []byte("\n"))
+	matches := yamlErrorLineRegexp.FindAllStringSubmatch(err.Error(), -1)
+	if len(matches) == 0 {
+		// errors from models.Commands reading commands don't have a line, so find the command it couldn't read
+		message := strings.TrimPrefix(err.Error(), "yaml: ")
+		if line, column, ok := unreadableCommandPosition(); ok {
+			return unsupportedInput("circle.yml:%d:%d: %s\n  %d | %s", line, column, message, line, lines[line-1])
+		}
+		return unsupportedInput("circle.yml: %s", message)
+	}
+	messages := []string{}
+	for _, match := range matches {
+		message := fmt.Sprintf("circle.yml:%s: %s", match[1], match[2])
+		if line, _ := strconv.Atoi(match[1]); line >= 1 && line <= len(lines) {
+			message += fmt.Sprintf("\n  %d | %s", line, lines[line-1])
+		}
+		messages = append(messages, message)
+	}
+	return unsupportedInput("%s", strings.Join(messages, "\n"))
+}
+
+// unreadableCommandPosition returns the line and column of the first command in a circle.yml command list
+// (e.g. test.override) that models.Commands can't read, e.g. a list instead of a string
+func unreadableCommandPosition() (int, int, bool) {
+	var root yamlnode.Node
+	if err := yamlnode.Unmarshal(circleCI1File, &root); err != nil || len(root.Content) == 0 {
+		return 0, 0, false
+	}
+	return unreadableCommandIn(root.Content[0], reflect.TypeOf(models.CircleYamlV1{}))
+}
+
+// unreadableCommandIn finds the first unreadable command in the models.Commands under node, which is read into t
+func unreadableCommandIn(node *yamlnode.Node, t reflect.Type) (int, int, bool) {
+	if t == reflect.TypeOf(models.Commands{}) && node.Kind == yamlnode.SequenceNode {
+		// read each command on its own, the same way the whole file is read
+		for _, command := range node.Content {
+			raw, err := yamlnode.Marshal([]*yamlnode.Node{command})
+			if err != nil {
+				continue
+			}
+			if err := yaml.Unmarshal(raw, &models.Commands{}); err != nil {
+				return command.Line, command.Column, true
+			}
+		}
+		return 0, 0, false
+	}
+	if node.Kind != yamlnode.MappingNode {
+		return 0, 0, false
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		valueType := t
+		switch t.Kind() {
+		case reflect.Map:
+			valueType = t.Elem()
+		case reflect.Struct:
+			field, ok := yamlField(t, node.Content[i].Value)
+			if !ok {
+				continue
+			}
+			valueType = field.Type
+		default:
+			return 0, 0, false
+		}
+		if line, column, ok := unreadableCommandIn(node.Content[i+1], valueType); ok {
+			return line, column, ok
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Clever/circle-v2-migrate/models"
+)
+
+func TestReportUnknownKeys(t *testing.T) {
+	defer func() {
+		circleCI1File = []byte{}
+		warnings = []models.Warning{}
+	}()
+	for _, test := range []struct {
+		name      string
+		circleYml string
+		// expected are the kind and rule of each warning
+		expected [][2]string
+		unknown  int
+	}{
+		{
+			name:      "known keys",
+			circleYml: "machine:\n  node:\n    version: 8\ndeployment:\n  master:\n    branch: master\n    commands:\n      - make deploy\n",
+			expected:  [][2]string{},
+		},
+		{
+			name:      "unknown top-level key",
+			circleYml: "machine:\n  node:\n    version: 8\ntests:\n  override:\n    - make test\n",
+			expected:  [][2]string{{UNKNOWN_KEY_WARNING, "tests"}},
+			unknown:   1,
+		},
+		{
+			name:      "unknown key in a deployment",
+			circleYml: "deployment:\n  master:\n    branches: master\n    commands:\n      - make deploy\n",
+			expected:  [][2]string{{UNKNOWN_KEY_WARNING, "deployment.master.branches"}},
+			unknown:   1,
+		},
+		{
+			name:      "unmodeled keys",
+			circleYml: "dependencies:\n  cache_directories:\n    - vendor\ndeployment:\n  prod:\n    codedeploy:\n      app: {}\n",
+			expected:  [][2]string{{UNMODELED_KEY_WARNING, "dependencies.cache_directories"}, {UNMODELED_KEY_WARNING, "deployment.prod.codedeploy"}},
+		},
+		{
+			name:      "unknown key next to an unmodeled one",
+			circleYml: "machine:\n  xcode:\n    version: 9\n  enviroment:\n    FOO: bar\n",
+			expected:  [][2]string{{UNMODELED_KEY_WARNING, "machine.xcode"}, {UNKNOWN_KEY_WARNING, "machine.enviroment"}},
+			unknown:   1,
+		},
+	} {
+		circleCI1File = []byte(test.circleYml)
+		warnings = []models.Warning{}
+		unknown := reportUnknownKeys()
+		found := [][2]string{}
+		for _, warning := range warnings {
+			found = append(found, [2]string{warning.Kind, warning.Evidence[0].Rule})
+		}
+		if unknown != test.unknown || !reflect.DeepEqual(found, test.expected) {
+			t.Errorf("%s: expected %d unknown and %v, got %d unknown and %v", test.name, test.unknown, test.expected, unknown, found)
+		}
+	}
+}
+
+func TestStrictExitCode(t *testing.T) {
+	defer func() {
+		circleCI1File = []byte{}
+		warnings = []models.Warning{}
+	}()
+	for _, test := range []struct {
+		name      string
+		circleYml string
+		strict    bool
+		expected  int
+	}{
+		{name: "unknown key", circleYml: "tests:\n  override:\n    - make test\n", strict: true, expected: EXIT_UNSUPPORTED_INPUT},
+		// the keys are still warnings
+		{name: "unknown key without --strict", circleYml: "tests:\n  override:\n    - make test\n", expected: EXIT_SUCCESS_WITH_WARNINGS},
+		{name: "unmodeled key", circleYml: "experimental:\n  notify: {}\n", strict: true, expected: EXIT_SUCCESS_WITH_WARNINGS},
+		{name: "known keys", circleYml: "test:\n  override:\n    - make test\n", strict: true, expected: EXIT_SUCCESS},
+	} {
+		circleCI1File = []byte(test.circleYml)
+		warnings = []models.Warning{}
+		if code := exitCode(checkUnknownKeys(test.strict)); code != test.expected {
+			t.Errorf("%s: expected exit code %d, got %d", test.name, test.expected, code)
+		}
+	}
+}